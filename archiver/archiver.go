@@ -3,56 +3,110 @@ package archiver
 import (
 	"fmt"
 	"os"
-	"path"
 	lg "s3-diff-archive/logger"
 	"s3-diff-archive/scanner"
+	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
 )
 
-func ArchiveToZip(task *utils.TaskConfig, scanRes *scanner.ScannedResult) []string {
+// ArchiveToZip zips the updated files of the scan into zips of at most
+// max_zip_size. If a file cannot be zipped, the zips are removed and the
+// error is returned.
+func ArchiveToZip(task *utils.TaskConfig, scanRes *scanner.ScannedResult) ([]*types.Archive, error) {
 
 	lg.Logs.Info("Total files to zip in task %s: %d", task.ID, len(scanRes.UpdatedFiles))
 
 	if len(scanRes.UpdatedFiles) == 0 {
 		lg.Logs.Info("No files to zip in task %s", task.ID)
-		return []string{}
+		return []*types.Archive{}, nil
 	}
 
 	maxZipSizeInBytes := task.MaxZipSize * 1024 * 1024
 	currentZippedFileSizeInBytes := int64(0)
 	totalZippedFilesSizeInBytes := int64(0)
-	zipFilePaths := []string{}
+	zipFilePaths := []*types.Archive{}
 
-	zipper := NewZipper(task.NewZipFileNameForTask(task.ID, 0))
+	zipPath := task.NewZipFileNameForTask(task.ID, 0)
+	zipper := NewZipper(zipPath)
 
 	totalFilesToZip := len(scanRes.UpdatedFiles)
+	fail := func(err error) ([]*types.Archive, error) {
+		println("")
+		zipper.Discard()
+		for _, archive := range zipFilePaths {
+			os.Remove(archive.Path)
+		}
+		return nil, err
+	}
 
-	for i := range totalFilesToZip {
+	zipStart := 0            // index of the first file of the current zip
+	retries := map[int]int{} // times each file was zipped again
+	for i := 0; i < totalFilesToZip; i++ {
 		file := scanRes.UpdatedFiles[i]
+		if !file.HasContent() {
+			// links and empty dirs are only recorded in the DB
+			continue
+		}
 		if currentZippedFileSizeInBytes+file.Size > maxZipSizeInBytes {
-			newPath := zipper.Flush()
-			if newPath != "" {
-				zipFilePaths = append(zipFilePaths, newPath)
+			archive := zipper.Flush()
+			if archive != nil {
+				zipFilePaths = append(zipFilePaths, archive)
 			}
-			zipper = NewZipper(task.NewZipFileNameForTask(task.ID, len(zipFilePaths)))
+			totalZippedFilesSizeInBytes += currentZippedFileSizeInBytes
+			zipPath = task.NewZipFileNameForTask(task.ID, len(zipFilePaths))
+			zipper = NewZipper(zipPath)
 			currentZippedFileSizeInBytes = 0
+			zipStart = i
 		}
 
-		fileStat, err := os.Stat(path.Join(task.Dir, file.RelativePath))
+		filePath := task.SourcePath(file.RelativePath)
+		fileStat, err := os.Stat(filePath)
+		if err != nil {
+			return fail(err)
+		}
+		checksum, holes, err := zipper.Zip(filePath, file.RelativePath, &fileStat, task.Password, true)
+		if err != nil {
+			return fail(err)
+		}
+		afterStat, err := os.Stat(filePath)
 		if err != nil {
-			lg.Logs.Fatal("%s", err.Error())
+			return fail(err)
+		}
+		changed := afterStat.Size() != fileStat.Size() || !afterStat.ModTime().Equal(fileStat.ModTime())
+		if changed && retries[i] < task.ChangeRetries {
+			retries[i]++
+			lg.Logs.Warn("%s changed while it was zipped, retrying (%d of %d)", filePath, retries[i], task.ChangeRetries)
+			// an entry cannot be taken out of a zip, so the zip is started
+			// over with the files zipped into it before this one
+			zipper.Discard()
+			zipper = NewZipper(zipPath)
+			currentZippedFileSizeInBytes = 0
+			i = zipStart - 1
+			continue
 		}
-		zipper.Zip(path.Join(task.Dir, file.RelativePath), file.RelativePath, &fileStat, task.Password)
+		if changed {
+			lg.Logs.Warn("%s kept changing while it was zipped, it is archived as is and will be archived again next run", filePath)
+		}
+
+		file.Hash, file.Holes = checksum, holes
+		file.Archive = utils.FileNameFromPath(zipPath)
+		// the DB describes the version that was zipped
+		file.Size = fileStat.Size()
+		file.Mtime = fileStat.ModTime().Unix()
+		file.Inconsistent = changed
 		currentZippedFileSizeInBytes += fileStat.Size()
-		totalZippedFilesSizeInBytes += fileStat.Size()
-		fmt.Printf("\r>>> Zipped: %d / %d files, Total Size: %d bytes", i+1, totalFilesToZip, totalZippedFilesSizeInBytes)
+		fmt.Printf("\r>>> Zipped: %d / %d files, Total Size: %d bytes", i+1, totalFilesToZip, totalZippedFilesSizeInBytes+currentZippedFileSizeInBytes)
 	}
 	println("")
-	newPath := zipper.Flush()
-	if newPath != "" {
-		zipFilePaths = append(zipFilePaths, newPath)
+	archive := zipper.Flush()
+	if archive != nil {
+		zipFilePaths = append(zipFilePaths, archive)
 	}
 	lg.Logs.Info("Total Zip file created in task %s: %d", task.ID, len(zipFilePaths))
+	inconsistent := len(utils.Where(scanRes.UpdatedFiles, func(file *types.SFile) bool { return file.Inconsistent }))
+	if inconsistent > 0 {
+		lg.Logs.Warn("%d files of task %s changed while they were zipped", inconsistent, task.ID)
+	}
 
-	return zipFilePaths
+	return zipFilePaths, nil
 }
@@ -0,0 +1,118 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	lg "s3-diff-archive/logger"
+	"s3-diff-archive/scanner"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// ArchiveCommand runs the command of a task and streams what it writes to
+// stdout into zips as the file named by the task, without writing it to disk
+// first. Output larger than a zip is split into volumes of one zip each; the
+// first is archived under the file name and the others under the name with
+// the volume number appended. A volume identical to the one in the DB, by
+// checksum, keeps its zip and is not uploaded again.
+//
+// The result lists the volumes like a scan lists files. Nothing is archived
+// if the command fails.
+func ArchiveCommand(rdb *badger.DB, task *utils.TaskConfig) (*scanner.ScannedResult, []*types.Archive, error) {
+	result := &scanner.ScannedResult{
+		UpdatedFiles:   []*types.SFile{},
+		SkippedFiles:   []*scanner.SkippedFile{},
+		UnChangedFiles: []*types.SFile{},
+		MetaChanged:    []*types.SFile{},
+	}
+	archives := []*types.Archive{}
+
+	lg.Logs.Info("Running the command of task %s: %s", task.ID, task.Command)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := utils.ShellCommand(ctx, task.Command)
+	cmd.Dir = task.Dir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to run the command of task %s: %w", task.ID, err)
+	}
+
+	output := bufio.NewReader(stdout)
+	volumeSize := task.MaxZipSize * 1024 * 1024
+	mtime := time.Now()
+	totalSize := int64(0)
+	for volume := 1; ; volume++ {
+		file := &types.SFile{RelativePath: task.FileName, Name: path.Base(task.FileName), Mtime: mtime.Unix()}
+		if volume > 1 {
+			file.RelativePath = fmt.Sprintf("%s.%03d", task.FileName, volume)
+			file.Name = path.Base(file.RelativePath)
+			file.Volume = volume
+			file.Target = task.FileName
+		}
+
+		zipPath := task.NewZipFileNameForTask(task.ID, volume-1)
+		zipper := NewZipper(zipPath)
+		file.Hash, file.Size, err = zipper.ZipStream(io.LimitReader(output, volumeSize), file.RelativePath, mtime, task.Password)
+		if err != nil {
+			zipper.Discard()
+			break
+		}
+		totalSize += file.Size
+		fmt.Printf("\r>>> Zipped: %d volumes, Total Size: %d bytes", volume, totalSize)
+
+		previous, _ := scanner.LookupSfile(rdb, file.RelativePath)
+		if previous != nil && previous.Archive != "" && previous.Hash == file.Hash && previous.Size == file.Size && previous.Volume == file.Volume {
+			zipper.Discard()
+			file.Archive = previous.Archive
+			file.Mtime = previous.Mtime
+			result.UnChangedFiles = append(result.UnChangedFiles, file)
+		} else {
+			file.Archive = utils.FileNameFromPath(zipPath)
+			archives = append(archives, zipper.Flush())
+			result.UpdatedFiles = append(result.UpdatedFiles, file)
+		}
+
+		if _, err = output.Peek(1); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+	}
+	println("")
+
+	if err != nil {
+		// stop the command rather than wait for it to fill the pipe
+		cancel()
+	}
+	waitErr := cmd.Wait()
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		lg.Logs.Info("Command of task %s wrote to stderr:\n%s", task.ID, message)
+	}
+	if err == nil && waitErr != nil {
+		err = fmt.Errorf("command of task %s failed: %w", task.ID, waitErr)
+	}
+	if err != nil {
+		for _, archive := range archives {
+			os.Remove(archive.Path)
+		}
+		return nil, nil, err
+	}
+
+	lg.Logs.Info("Archived %d bytes of output of task %s in %d volumes, %d of them changed", totalSize, task.ID, len(result.UpdatedFiles)+len(result.UnChangedFiles), len(result.UpdatedFiles))
+	return result, archives, nil
+}
@@ -1,8 +1,14 @@
 package archiver
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
 	"os"
+	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
+	"time"
 
 	"github.com/alexmullins/zip"
 )
@@ -10,36 +16,70 @@ import (
 type Zipper struct {
 	file             *os.File
 	zw               *zip.Writer
+	hash             hash.Hash
+	written          *countingWriter
 	totalSizeInBytes int64
 	fileCounts       int
 }
 
-func (c *Zipper) Flush() string {
-	filePath := c.file.Name()
-	if c.fileCounts == 0 {
-		filePath = ""
+// Flush closes the zip and returns it with its checksum, or nil when nothing
+// was zipped.
+func (c *Zipper) Flush() *types.Archive {
+	if c.zw != nil {
+		c.zw.Close()
 	}
 	if c.file != nil {
-		defer c.file.Close()
-	}
-	if c.zw != nil {
-		defer c.zw.Close()
+		c.file.Close()
 	}
-	if c.fileCounts <= 0 && c.file != nil {
-		defer os.Remove(c.file.Name())
+
+	var archive *types.Archive
+	if c.fileCounts > 0 {
+		archive = &types.Archive{
+			Path:   c.file.Name(),
+			Size:   c.written.n,
+			SHA256: hex.EncodeToString(c.hash.Sum(nil)),
+			Files:  c.fileCounts,
+			Bytes:  c.totalSizeInBytes,
+		}
+	} else if c.file != nil {
+		os.Remove(c.file.Name())
 	}
 
-	// After defers
 	c.file = nil
 	c.zw = nil
 	c.totalSizeInBytes = 0
-	return filePath
+	c.fileCounts = 0
+	return archive
 }
 
-func (c *Zipper) Zip(filePath string, filename string, fileStat *os.FileInfo, password string) {
-	utils.ZipFile(filePath, filename, fileStat, c.zw, password)
+// Discard closes the zip and removes it.
+func (c *Zipper) Discard() {
+	c.fileCounts = 0
+	c.Flush()
+}
+
+// Zip adds a file and returns the hex SHA-256 of its content. With sparse,
+// the holes of a sparse file are left out and returned.
+func (c *Zipper) Zip(filePath string, filename string, fileStat *os.FileInfo, password string, sparse bool) (string, []types.Extent, error) {
+	checksum, holes, err := utils.ZipFile(filePath, filename, fileStat, c.zw, password, sparse)
+	if err != nil {
+		return "", nil, err
+	}
 	c.totalSizeInBytes += (*fileStat).Size()
+	for _, hole := range holes {
+		c.totalSizeInBytes -= hole.Length
+	}
 	c.fileCounts++
+	return checksum, holes, nil
+}
+
+// ZipStream adds an entry holding everything read from r and returns the hex
+// SHA-256 of the content and its size.
+func (c *Zipper) ZipStream(r io.Reader, filename string, mtime time.Time, password string) (string, int64, error) {
+	checksum, size, err := utils.ZipStream(r, filename, mtime, c.zw, password)
+	c.totalSizeInBytes += size
+	c.fileCounts++
+	return checksum, size, err
 }
 
 func NewZipper(outputFile string) *Zipper {
@@ -49,9 +89,24 @@ func NewZipper(outputFile string) *Zipper {
 		panic(err)
 	}
 
+	// checksum the zip while it is written, so it never has to be read back
+	checksum := sha256.New()
+	written := &countingWriter{}
+
 	return &Zipper{
 		file:             outFile,
-		zw:               zip.NewWriter(outFile),
+		zw:               zip.NewWriter(io.MultiWriter(outFile, checksum, written)),
+		hash:             checksum,
+		written:          written,
 		totalSizeInBytes: 0,
 	}
 }
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -6,6 +6,7 @@ import (
 	lg "s3-diff-archive/logger"
 	"s3-diff-archive/restorer"
 	"s3-diff-archive/scanner"
+	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
 	"testing"
 )
@@ -30,11 +31,14 @@ func TestArchiving(t *testing.T) {
 	scanned := scanner.ScanTask(tempDB.GetDB(), task)
 	println(scanned.SkippedFiles)
 
-	archived := archiver.ArchiveToZip(task, scanned)
+	archived, err := archiver.ArchiveToZip(task, scanned)
+	if err != nil {
+		panic(err)
+	}
 	println(archived)
 
 	// err := restorer.RestoreFromZips([]string{"tmp/photos_2025_07_26_05_42_35.zip", "tmp/photos_2025_07_26_05_42_40_1.zip", "tmp/photos_2025_07_26_05_42_44_2.zip"}, "./tmp/restored", "PASasdSWORD")
-	err = restorer.RestoreFromZips(archived, "./tmp/restored", "PASasdSWORD")
+	err = restorer.RestoreFromZips(types.ArchivesToPaths(archived), "./tmp/restored", "PASasdSWORD")
 	if err != nil {
 		panic(err)
 	}
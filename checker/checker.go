@@ -0,0 +1,218 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"s3-diff-archive/db"
+	lg "s3-diff-archive/logger"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	LevelQuick = "quick"
+	LevelFull  = "full"
+)
+
+type Options struct {
+	Level   string
+	Percent int // share of the zips read by a full check
+}
+
+// Problem is something wrong with an object of the task. Damage means a
+// restore would lose data; other problems are worth a look but harmless.
+type Problem struct {
+	Key    string
+	Detail string
+	Damage bool
+}
+
+type Report struct {
+	TaskID      string
+	Objects     int // objects checked with HeadObject
+	ZipsRead    int
+	ZipsSkipped int // cold zips that need a restore before they can be read
+	Entries     int // zip entries verified
+	Problems    []*Problem
+}
+
+func (r *Report) Damaged() bool {
+	for _, problem := range r.Problems {
+		if problem.Damage {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) Message() string {
+	status := "OK"
+	if r.Damaged() {
+		status = "DAMAGED"
+	} else if len(r.Problems) > 0 {
+		status = "WARNINGS"
+	}
+	return fmt.Sprintf("Task: %s, %s, Objects: %d, Zips read: %d, Zips skipped: %d, Entries verified: %d, Problems: %d",
+		r.TaskID, status, r.Objects, r.ZipsRead, r.ZipsSkipped, r.Entries, len(r.Problems))
+}
+
+func (r *Report) add(key string, damage bool, detail string, args ...any) {
+	problem := &Problem{Key: key, Detail: fmt.Sprintf(detail, args...), Damage: damage}
+	if damage {
+		lg.Logs.Error("%s: %s", key, problem.Detail)
+	} else {
+		lg.Logs.Warn("%s: %s", key, problem.Detail)
+	}
+	r.Problems = append(r.Problems, problem)
+}
+
+// CheckTask verifies that the current DB of the task can be restored. The
+// quick level confirms that every object of every committed manifest exists
+// with the expected size and storage class, and that every file of the
+// current DB is in a committed zip. The full level also downloads a share of
+// the zips the current DB uses, decrypts them and compares the SHA-256 of
+// each entry with the one recorded in the DB.
+func CheckTask(task *utils.TaskConfig, opts *Options) (*Report, error) {
+	report := &Report{TaskID: task.ID}
+
+	manifests, err := db.FetchCommittedManifests(task)
+	if err != nil {
+		return nil, err
+	}
+	committed := map[string]*db.ManifestObject{}
+	for _, manifest := range manifests {
+		for _, object := range manifest.Archives {
+			committed[object.Key] = object
+			checkObject(task, object, true, report)
+		}
+		if manifest.DB != nil {
+			// db_history deletes old DB generations, so with it a missing
+			// one does not mean damage
+			checkObject(task, manifest.DB, task.DBHistory == 0, report)
+		}
+	}
+	fileReg, err := db.FetchRegOfTask(task)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range db.ParseReg(fileReg) {
+		checkObject(task, &db.ManifestObject{Key: entry.Name}, true, report)
+	}
+
+	refDB := db.FetchRemoteDB(task)
+	defer refDB.Close()
+	byArchive := map[string][]*types.SFile{}
+	err = refDB.ForEachSfile(func(file *types.SFile) error {
+		if file.Archive == "" {
+			return nil
+		}
+		if _, ok := committed[file.Archive]; !ok {
+			report.add(file.Archive, true, "holds %s but is not part of a committed run", file.RelativePath)
+			return nil
+		}
+		byArchive[file.Archive] = append(byArchive[file.Archive], file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Level != LevelFull {
+		return report, nil
+	}
+
+	archives := []string{}
+	for archive := range byArchive {
+		archives = append(archives, archive)
+	}
+	sort.Strings(archives)
+	rand.Shuffle(len(archives), func(i, j int) { archives[i], archives[j] = archives[j], archives[i] })
+	count := (len(archives)*opts.Percent + 99) / 100
+	lg.Logs.Info("Reading %d of %d zips of task %s", count, len(archives), task.ID)
+	for _, archive := range archives[:count] {
+		checkArchive(task, committed[archive], byArchive[archive], report)
+	}
+	return report, nil
+}
+
+// checkObject confirms with HeadObject that the object exists with the
+// expected size and storage class.
+func checkObject(task *utils.TaskConfig, object *db.ManifestObject, missingIsDamage bool, report *Report) {
+	report.Objects++
+	head, err := s3.HeadFileInS3(task.CreateS3Config(task.StorageClass), context.TODO(), object.Key)
+	if err != nil {
+		if err.Error() == "not-found" {
+			report.add(object.Key, missingIsDamage, "missing")
+		} else {
+			report.add(object.Key, true, "cannot be read: %s", err.Error())
+		}
+		return
+	}
+	if object.Size != 0 && aws.ToInt64(head.ContentLength) != object.Size {
+		report.add(object.Key, true, "size is %d bytes, expected %d", aws.ToInt64(head.ContentLength), object.Size)
+	}
+	class := s3Types.StorageClass(head.StorageClass)
+	if class == "" {
+		class = s3Types.StorageClassStandard
+	}
+	if object.StorageClass != "" && string(class) != object.StorageClass {
+		report.add(object.Key, false, "storage class is %s, expected %s", class, object.StorageClass)
+	}
+}
+
+// checkArchive downloads a zip, verifying its checksum, and compares every
+// entry the DB expects in it with the DB.
+func checkArchive(task *utils.TaskConfig, object *db.ManifestObject, files []*types.SFile, report *Report) {
+	if s3.NeedsRestore(s3Types.StorageClass(object.StorageClass)) {
+		state, err := s3.ObjectRestoreState(task.CreateS3Config(task.StorageClass), context.TODO(), object.Key)
+		if err == nil && state != s3.RestoreAvailable {
+			lg.Logs.Info("Skipping %s, it is in %s and not restored", object.Key, object.StorageClass)
+			report.ZipsSkipped++
+			return
+		}
+	}
+
+	downloadPath := path.Join(task.WorkingDir, task.ID, "check-"+object.Key)
+	err := s3.DownloadFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), object.Key, downloadPath, object.SHA256)
+	if err != nil {
+		report.add(object.Key, true, "download failed: %s", err.Error())
+		return
+	}
+	defer os.Remove(downloadPath)
+	report.ZipsRead++
+
+	expected := map[string]*types.SFile{}
+	for _, file := range files {
+		expected[file.RelativePath] = file
+	}
+	err = utils.HashZipEntries(downloadPath, task.Password, func(name, checksum string, err error) error {
+		file, ok := expected[name]
+		if !ok {
+			// superseded version of a file
+			return nil
+		}
+		delete(expected, name)
+		report.Entries++
+		if err != nil {
+			report.add(object.Key, true, "entry %s cannot be read: %s", name, err.Error())
+		} else if file.Hash != "" && checksum != file.Hash {
+			report.add(object.Key, true, "entry %s has SHA-256 %s, the DB expects %s", name, checksum, file.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		report.add(object.Key, true, "%s", err.Error())
+		return
+	}
+	for name := range expected {
+		report.add(object.Key, true, "entry %s is missing", name)
+	}
+}
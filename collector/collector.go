@@ -0,0 +1,174 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"s3-diff-archive/db"
+	lg "s3-diff-archive/logger"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	Delete bool          // delete orphans older than Grace
+	Grace  time.Duration // orphans younger than this may belong to a running archive
+}
+
+// MissingObject is a reference to an object that does not exist.
+type MissingObject struct {
+	Key          string
+	ReferencedBy string
+}
+
+type Report struct {
+	TaskID   string
+	Objects  int
+	Orphans  []*types.S3Object
+	Pending  []*types.S3Object // orphans that belong to an unfinished upload of this host
+	Missing  []*MissingObject
+	Deleted  []*types.S3Object
+	Deferred []*types.S3Object // orphans younger than the grace period
+}
+
+func (r *Report) OrphanBytes() int64 {
+	var size int64
+	for _, object := range r.Orphans {
+		size += object.Size
+	}
+	return size
+}
+
+func (r *Report) Message() string {
+	return fmt.Sprintf("Task: %s, Objects: %d, Unreferenced: %d (%d MB), Missing: %d, Deleted: %d",
+		r.TaskID, r.Objects, len(r.Orphans), r.OrphanBytes()/1024/1024, len(r.Missing), len(r.Deleted))
+}
+
+// CollectTask lists every object under the prefix of the task and cross
+// references them with its manifests, DB history and reg file. It reports
+// objects nothing references, such as the uploads of runs that crashed before
+// they were committed, and references to objects that are missing. With
+// Delete, orphans older than the grace period are deleted.
+func CollectTask(task *utils.TaskConfig, opts *Options) (*Report, error) {
+	report := &Report{TaskID: task.ID}
+
+	objects, err := s3.ListFilesInS3(task.CreateS3Config(task.StorageClass), context.TODO(), "")
+	if err != nil {
+		return nil, err
+	}
+	report.Objects = len(objects)
+	existing := map[string]bool{}
+	for _, object := range objects {
+		existing[object.Key] = true
+	}
+
+	referenced := map[string]string{} // key to what references it
+	for _, key := range db.ControlKeys(task) {
+		referenced[key] = "task"
+	}
+	referenced[s3.TaskLockKey] = "task"
+
+	manifests, err := db.FetchCommittedManifests(task)
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		by := "manifest " + manifest.RunID
+		referenced[db.ManifestKey(manifest.RunID)] = by
+		for _, zip := range manifest.Archives {
+			referenced[zip.Key] = by
+			if !existing[zip.Key] {
+				report.Missing = append(report.Missing, &MissingObject{Key: zip.Key, ReferencedBy: by})
+			}
+		}
+		if manifest.DB != nil {
+			referenced[manifest.DB.Key] = by
+			// DB generations may be deleted by db_history, so a missing one
+			// is not reported
+		}
+	}
+
+	snapshots, err := db.ListSnapshots(task)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if _, ok := referenced[snapshot.Key]; !ok {
+			referenced[snapshot.Key] = "legacy run " + snapshot.RunID
+		}
+	}
+
+	pointer, err := db.FetchDBPointer(task)
+	if err != nil {
+		return nil, err
+	}
+	if pointer != nil {
+		referenced[pointer.Key] = "DB pointer"
+		if !existing[pointer.Key] {
+			report.Missing = append(report.Missing, &MissingObject{Key: pointer.Key, ReferencedBy: "DB pointer"})
+		}
+	}
+
+	fileReg, err := db.FetchRegOfTask(task)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range db.ParseReg(fileReg) {
+		referenced[entry.Name] = "reg file"
+		if !existing[entry.Name] {
+			report.Missing = append(report.Missing, &MissingObject{Key: entry.Name, ReferencedBy: "reg file"})
+		}
+	}
+
+	pending := []string{}
+	uploader, err := s3.LoadPendingUpload(task)
+	if err != nil {
+		return nil, err
+	}
+	if uploader != nil {
+		for _, archive := range uploader.ArchivedFiles {
+			pending = append(pending, utils.FileNameFromPath(archive.Path))
+		}
+		pending = append(pending, uploader.DBKey)
+	}
+
+	now := time.Now()
+	for _, object := range objects {
+		if _, ok := referenced[object.Key]; ok {
+			continue
+		}
+		if slices.Contains(pending, object.Key) {
+			lg.Logs.Info("Pending: %s belongs to the unfinished upload of run %s", object.Key, uploader.RunID)
+			report.Pending = append(report.Pending, object)
+			continue
+		}
+		lg.Logs.Info("Unreferenced: %s, %d bytes, %s, modified %s", object.Key, object.Size, object.StorageClass, object.LastModified.Format(time.RFC3339))
+		report.Orphans = append(report.Orphans, object)
+	}
+	for _, missing := range report.Missing {
+		lg.Logs.Warn("Missing: %s referenced by %s", missing.Key, missing.ReferencedBy)
+	}
+
+	if !opts.Delete {
+		return report, nil
+	}
+	for _, object := range report.Orphans {
+		if now.Sub(object.LastModified) < opts.Grace {
+			report.Deferred = append(report.Deferred, object)
+			continue
+		}
+		err := s3.DeleteFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), object.Key)
+		if err != nil {
+			lg.Logs.Warn("%s", err.Error())
+			continue
+		}
+		report.Deleted = append(report.Deleted, object)
+	}
+	if len(report.Deferred) > 0 {
+		lg.Logs.Info("%d unreferenced objects of task %s are younger than %s and were kept", len(report.Deferred), task.ID, strings.TrimSuffix(opts.Grace.String(), "0m0s"))
+	}
+	return report, nil
+}
@@ -44,7 +44,7 @@ func (c *DBContainer) CloseNoDel() string {
 	return c.dir
 }
 
-func (c *DBContainer) CloseAndZip(password string) (string, error) {
+func (c *DBContainer) CloseAndZip(password string) (*types.Archive, error) {
 	c.closed = true
 	if c.db != nil {
 		c.db.Close()
@@ -89,3 +89,42 @@ func (c *DBContainer) InsertSfilesToDB(files []*types.SFile) {
 		}
 	}
 }
+
+// ForEachSfile calls fn with every file recorded in the DB.
+func (c *DBContainer) ForEachSfile(fn func(*types.SFile) error) error {
+	return c.GetDB().View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var file types.SFile
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &file)
+			})
+			if err != nil {
+				return err
+			}
+			if err := fn(&file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateSfiles calls fn with every file recorded in the DB and stores the
+// files for which it returns true. It returns the number of files stored.
+func (c *DBContainer) UpdateSfiles(fn func(*types.SFile) bool) (int, error) {
+	changed := []*types.SFile{}
+	err := c.ForEachSfile(func(file *types.SFile) error {
+		if fn(file) {
+			changed = append(changed, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.InsertSfilesToDB(changed)
+	return len(changed), nil
+}
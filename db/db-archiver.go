@@ -5,15 +5,16 @@ import (
 	"os"
 	"path"
 	"s3-diff-archive/archiver"
+	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
 )
 
-func archiveDB(dbPath string, encryptPass string) (string, error) {
+func archiveDB(dbPath string, encryptPass string) (*types.Archive, error) {
 	parentOfDBPath := path.Dir(dbPath)
 	zipper := archiver.NewZipper(path.Join(parentOfDBPath, fmt.Sprintf("db-%s-%s.zip", utils.GenerateRandString(5), utils.NowTime())))
 	filesOfDB, err := os.ReadDir(dbPath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	for _, file := range filesOfDB {
 		if file.IsDir() {
@@ -22,13 +23,16 @@ func archiveDB(dbPath string, encryptPass string) (string, error) {
 		filePath := dbPath + "/" + file.Name()
 		stats, err := os.Stat(filePath)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		if _, _, err := zipper.Zip(filePath, file.Name(), &stats, encryptPass, false); err != nil {
+			zipper.Discard()
+			return nil, err
 		}
-		zipper.Zip(filePath, file.Name(), &stats, encryptPass)
 	}
-	newPath := zipper.Flush()
-	if newPath != "" {
-		return newPath, nil
+	archive := zipper.Flush()
+	if archive != nil {
+		return archive, nil
 	}
-	return "", fmt.Errorf("failed to create zip file")
+	return nil, fmt.Errorf("failed to create zip file")
 }
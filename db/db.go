@@ -14,8 +14,7 @@ import (
 )
 
 func getDB(dbPath string) *badger.DB {
-	opts := badger.DefaultOptions(dbPath).WithLoggingLevel(badger.ERROR)
-	db, err := badger.Open(opts)
+	db, err := openDB(dbPath)
 	if err != nil {
 		lg.Logs.Fatal("%s", err.Error())
 	}
@@ -23,24 +22,57 @@ func getDB(dbPath string) *badger.DB {
 	return db
 }
 
+func openDB(dbPath string) (*badger.DB, error) {
+	opts := badger.DefaultOptions(dbPath).WithLoggingLevel(badger.ERROR)
+	return badger.Open(opts)
+}
+
+// FetchRemoteDB downloads the current DB of the task, see CurrentDB.
 func FetchRemoteDB(task *utils.TaskConfig) *DBContainer {
-	tempDBPath := path.Join(task.WorkingDir, task.ID, "db.zip")
-	refDBPath := path.Join(task.WorkingDir, task.ID, "db-remote")
-	err := s3.DownloadFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), "db.zip", tempDBPath)
+	refDB, err := OpenRemoteDB(task)
+	if err != nil {
+		lg.Logs.Fatal("%s", err.Error())
+	}
+	return refDB
+}
+
+// OpenRemoteDB downloads and opens the current DB of the task like
+// FetchRemoteDB, returning an error instead of exiting when it cannot.
+func OpenRemoteDB(task *utils.TaskConfig) (*DBContainer, error) {
+	current, err := CurrentDB(task)
+	if err != nil {
+		return nil, err
+	}
+	if current.RunID != "" {
+		lg.Logs.Info("Using DB of run %s", current.RunID)
+	}
+	refDB, err := fetchDB(task, current.Key, current.SHA256, path.Join(task.WorkingDir, task.ID, "db-remote"))
+	if err != nil {
+		return nil, err
+	}
+	refDB.db, err = openDB(refDB.dir)
+	if err != nil {
+		return nil, err
+	}
+	return refDB, nil
+}
+
+func fetchDB(task *utils.TaskConfig, key, checksum, refDBPath string) (*DBContainer, error) {
+	tempDBPath := refDBPath + ".zip"
+	_ = os.RemoveAll(refDBPath)
+	defer os.Remove(tempDBPath)
+	err := s3.DownloadFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), key, tempDBPath, checksum)
 	if err != nil {
-		if err.Error() == "not-found" {
-			lg.Logs.Warn("Remote DB not found, Treating as a new backup task")
-		} else {
-			lg.Logs.Fatal("%s", err.Error())
+		if err.Error() != "not-found" {
+			return nil, err
 		}
+		lg.Logs.Warn("Remote DB not found, Treating as a new backup task")
 	} else {
 		err := utils.Unzip(tempDBPath, refDBPath, task.Password)
 		if err != nil {
-			lg.Logs.Fatal("%s", err.Error())
-		} else {
-			lg.Logs.Info("DB unzipped")
+			return nil, err
 		}
+		lg.Logs.Info("DB unzipped")
 	}
-	_ = os.Remove(tempDBPath)
-	return &DBContainer{dir: refDBPath}
+	return &DBContainer{dir: refDBPath}, nil
 }
@@ -0,0 +1,360 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	lg "s3-diff-archive/logger"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/utils"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Every archive run uploads its DB as a new generation under dbs/. The
+// pointer object names the generation the next run is computed against, so a
+// bad DB can be rolled back by moving the pointer.
+const (
+	dbHistoryPrefix = "dbs/"
+	dbPointerKey    = "db-current.json"
+	legacyDBKey     = "db.zip"
+)
+
+// ControlKeys returns the keys of the single objects that describe the task,
+// next to its zips, DB generations and manifests.
+func ControlKeys(task *utils.TaskConfig) []string {
+	return []string{dbPointerKey, legacyDBKey, regKey(task)}
+}
+
+// DBPointer is the content of the pointer object.
+type DBPointer struct {
+	RunID     string    `json:"run_id"`
+	Key       string    `json:"key"`
+	SHA256    string    `json:"sha256"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DBRef locates a DB generation.
+type DBRef struct {
+	RunID  string // empty for the legacy db.zip
+	Key    string
+	SHA256 string
+}
+
+// isCommitted reports whether the run was committed by a manifest. Runs older
+// than the first manifest were archived before manifests existed and count
+// as committed.
+func isCommitted(committedRuns []string, runID string) bool {
+	if len(committedRuns) == 0 || runID < committedRuns[0] {
+		return true
+	}
+	return slices.Contains(committedRuns, runID)
+}
+
+// CurrentDB returns the DB the next run of the task is computed against: the
+// one named by the DB pointer, unless the pointer names a run that was never
+// committed, in which case the latest committed run is used. Tasks archived
+// before DB history use their db.zip.
+func CurrentDB(task *utils.TaskConfig) (*DBRef, error) {
+	committedRuns, err := ListCommittedRuns(task)
+	if err != nil {
+		return nil, err
+	}
+	pointer, err := FetchDBPointer(task)
+	if err != nil {
+		return nil, err
+	}
+
+	runID := ""
+	if pointer != nil && isCommitted(committedRuns, pointer.RunID) {
+		runID = pointer.RunID
+	} else if len(committedRuns) > 0 {
+		runID, err = latestRunWithDB(task, committedRuns)
+		if err != nil {
+			return nil, err
+		}
+		if pointer != nil {
+			lg.Logs.Warn("DB pointer of task %s names run %s which was never committed, using run %s", task.ID, pointer.RunID, runID)
+		}
+	}
+	if runID == "" {
+		return &DBRef{Key: legacyDBKey}, nil
+	}
+	if pointer != nil && pointer.RunID == runID && pointer.SHA256 != "" {
+		return &DBRef{RunID: runID, Key: pointer.Key, SHA256: pointer.SHA256}, nil
+	}
+	return dbOfRun(task, committedRuns, runID)
+}
+
+// dbOfRun locates the DB of a run, using its manifest when it has one.
+func dbOfRun(task *utils.TaskConfig, committedRuns []string, runID string) (*DBRef, error) {
+	if slices.Contains(committedRuns, runID) {
+		manifest, err := FetchManifest(task, runID)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Pruned() {
+			return nil, fmt.Errorf("run %s of task %s was pruned", runID, task.ID)
+		}
+		if manifest.DB == nil {
+			return nil, fmt.Errorf("run %s of task %s has no DB", runID, task.ID)
+		}
+		return &DBRef{RunID: runID, Key: manifest.DB.Key, SHA256: manifest.DB.SHA256}, nil
+	}
+	// the checksum is left empty, downloads verify against the object metadata
+	return &DBRef{RunID: runID, Key: GenerationKey(runID)}, nil
+}
+
+// latestRunWithDB returns the latest committed run that still has a DB,
+// skipping repacks and pruned runs.
+func latestRunWithDB(task *utils.TaskConfig, committedRuns []string) (string, error) {
+	for i := len(committedRuns) - 1; i >= 0; i-- {
+		manifest, err := FetchManifest(task, committedRuns[i])
+		if err != nil {
+			return "", err
+		}
+		if manifest.DB != nil {
+			return manifest.RunID, nil
+		}
+	}
+	return "", nil
+}
+
+// DBGeneration is a DB uploaded by an archive run.
+type DBGeneration struct {
+	RunID        string
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// GenerationKey returns the key the DB of a run is uploaded to.
+func GenerationKey(runID string) string {
+	return fmt.Sprintf("%sdb-%s.zip", dbHistoryPrefix, runID)
+}
+
+func runIDFromGenerationKey(key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, dbHistoryPrefix+"db-"), ".zip")
+}
+
+// FetchDBPointer returns the current DB pointer of the task, or nil if the
+// task has none yet.
+func FetchDBPointer(task *utils.TaskConfig) (*DBPointer, error) {
+	var pointer DBPointer
+	err := fetchJSON(task, dbPointerKey, &pointer)
+	if err != nil {
+		if err.Error() == "not-found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &pointer, nil
+}
+
+// SetDBPointer makes the DB of runID the current one.
+func SetDBPointer(task *utils.TaskConfig, runID string, checksum string) error {
+	pointer := &DBPointer{
+		RunID:     runID,
+		Key:       GenerationKey(runID),
+		SHA256:    checksum,
+		UpdatedAt: time.Now().UTC(),
+	}
+	err := uploadJSON(task, dbPointerKey, pointer)
+	if err != nil {
+		return err
+	}
+	lg.Logs.Info("DB of task %s now points to run %s", task.ID, runID)
+	return nil
+}
+
+// ListDBHistory returns the DB generations of the task, oldest first.
+func ListDBHistory(task *utils.TaskConfig) ([]*DBGeneration, error) {
+	objects, err := s3.ListFilesInS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), dbHistoryPrefix)
+	if err != nil {
+		return nil, err
+	}
+	generations := []*DBGeneration{}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".zip") {
+			continue
+		}
+		generations = append(generations, &DBGeneration{
+			RunID:        runIDFromGenerationKey(object.Key),
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	}
+	// run ids are UTC timestamps, so they sort chronologically
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].RunID < generations[j].RunID
+	})
+	return generations, nil
+}
+
+// ListSnapshots returns the DB generations of committed runs, oldest first.
+// These are the states of the task that can be rolled back to or restored.
+func ListSnapshots(task *utils.TaskConfig) ([]*DBGeneration, error) {
+	generations, err := ListDBHistory(task)
+	if err != nil {
+		return nil, err
+	}
+	committedRuns, err := ListCommittedRuns(task)
+	if err != nil {
+		return nil, err
+	}
+	return utils.Where(generations, func(generation *DBGeneration) bool {
+		return isCommitted(committedRuns, generation.RunID)
+	}), nil
+}
+
+// FetchDBOfRun downloads the DB of a committed run.
+func FetchDBOfRun(task *utils.TaskConfig, runID string) (*DBContainer, error) {
+	committedRuns, err := ListCommittedRuns(task)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := dbOfRun(task, committedRuns, runID)
+	if err != nil {
+		return nil, err
+	}
+	return fetchDB(task, ref.Key, ref.SHA256, path.Join(task.WorkingDir, task.ID, "db-"+runID))
+}
+
+// ReplaceDBOfRun uploads refDB, closing it, as the DB of a committed run and
+// updates the manifest of the run and the DB pointer to its new checksum.
+func ReplaceDBOfRun(task *utils.TaskConfig, runID string, refDB *DBContainer) error {
+	zippedDB, err := refDB.CloseAndZip(task.Password)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(zippedDB.Path)
+
+	key := GenerationKey(runID)
+	err = s3.UploadFileToS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), key, zippedDB.Path, zippedDB.SHA256)
+	if err != nil {
+		return err
+	}
+
+	committedRuns, err := ListCommittedRuns(task)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(committedRuns, runID) {
+		manifest, err := FetchManifest(task, runID)
+		if err != nil {
+			return err
+		}
+		manifest.DB = dbManifestObject(key, zippedDB)
+		err = CommitManifest(task, manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	pointer, err := FetchDBPointer(task)
+	if err != nil {
+		return err
+	}
+	if pointer != nil && pointer.RunID == runID {
+		return SetDBPointer(task, runID, zippedDB.SHA256)
+	}
+	return nil
+}
+
+// DeleteDBGeneration deletes the DB uploaded by a run.
+func DeleteDBGeneration(task *utils.TaskConfig, runID string) error {
+	return s3.DeleteFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), GenerationKey(runID))
+}
+
+// PruneDBHistory deletes the oldest DB generations so that at most keep
+// remain. The current generation is never deleted. keep <= 0 keeps all.
+func PruneDBHistory(task *utils.TaskConfig, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	generations, err := ListDBHistory(task)
+	if err != nil {
+		return err
+	}
+	if len(generations) <= keep {
+		return nil
+	}
+	pointer, err := FetchDBPointer(task)
+	if err != nil {
+		return err
+	}
+
+	for _, generation := range generations[:len(generations)-keep] {
+		if pointer != nil && generation.Key == pointer.Key {
+			continue
+		}
+		lg.Logs.Info("Deleting DB generation %s of task %s", generation.RunID, task.ID)
+		err := s3.DeleteFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), generation.Key)
+		if err != nil {
+			lg.Logs.Warn("%s", err.Error())
+		}
+	}
+	return nil
+}
+
+// RollbackDB points the task at the DB of runID. An empty runID rolls back to
+// the generation before the current one.
+func RollbackDB(task *utils.TaskConfig, runID string) (*DBGeneration, error) {
+	generations, err := ListSnapshots(task)
+	if err != nil {
+		return nil, err
+	}
+	committedRuns, err := ListCommittedRuns(task)
+	if err != nil {
+		return nil, err
+	}
+	if len(generations) == 0 {
+		return nil, fmt.Errorf("task %s has no DB history", task.ID)
+	}
+
+	var target *DBGeneration
+	if runID != "" {
+		for _, generation := range generations {
+			if generation.RunID == runID {
+				target = generation
+				break
+			}
+		}
+		if target == nil {
+			return nil, fmt.Errorf("no DB generation for run %s in task %s", runID, task.ID)
+		}
+	} else {
+		pointer, err := FetchDBPointer(task)
+		if err != nil {
+			return nil, err
+		}
+		if pointer == nil {
+			return nil, fmt.Errorf("task %s has no current DB to roll back from", task.ID)
+		}
+		for _, generation := range generations {
+			if generation.RunID >= pointer.RunID {
+				break
+			}
+			target = generation
+		}
+		if target == nil {
+			return nil, fmt.Errorf("task %s has no DB generation before the current one", task.ID)
+		}
+	}
+
+	ref, err := dbOfRun(task, committedRuns, target.RunID)
+	if err != nil {
+		return nil, err
+	}
+	err = SetDBPointer(task, target.RunID, ref.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
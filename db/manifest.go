@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"sort"
+	"strings"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// A run is committed by writing its manifest, after all of its zips and its
+// DB are uploaded. Objects that no committed manifest references belong to a
+// run that never finished and are ignored by readers.
+const manifestPrefix = "manifests/"
+
+// ManifestObject is an object uploaded by a run. Files and Bytes count the
+// entries of a zip and their uncompressed size; they are zero in manifests
+// written before they were recorded.
+type ManifestObject struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	StorageClass string `json:"storage_class"`
+	Files        int    `json:"files,omitempty"`
+	Bytes        int64  `json:"bytes,omitempty"`
+}
+
+// RunKindRepack marks the manifest of a repack, which uploads zips but no DB.
+const RunKindRepack = "repack"
+
+type Manifest struct {
+	RunID     string            `json:"run_id"`
+	TaskID    string            `json:"task_id"`
+	Kind      string            `json:"kind,omitempty"` // empty for archive runs
+	CreatedAt time.Time         `json:"created_at"`
+	Archives  []*ManifestObject `json:"archives"`
+	DB        *ManifestObject   `json:"db"`
+	PrunedAt  *time.Time        `json:"pruned_at,omitempty"`
+}
+
+// Pruned reports whether the run was removed by prune. The manifest of a
+// pruned run has no DB and lists only the zips that could not be deleted yet.
+func (m *Manifest) Pruned() bool {
+	return m.PrunedAt != nil
+}
+
+func ManifestKey(runID string) string {
+	return fmt.Sprintf("%s%s.json", manifestPrefix, runID)
+}
+
+// NewManifest describes a run. dbZip is nil for runs that upload no DB.
+func NewManifest(task *utils.TaskConfig, runID string, archives []*types.Archive, dbZip *types.Archive, dbKey string) *Manifest {
+	manifest := &Manifest{
+		RunID:     runID,
+		TaskID:    task.ID,
+		CreatedAt: time.Now().UTC(),
+		Archives:  []*ManifestObject{},
+	}
+	if dbZip != nil {
+		manifest.DB = dbManifestObject(dbKey, dbZip)
+	}
+	for _, archive := range archives {
+		manifest.Archives = append(manifest.Archives, &ManifestObject{
+			Key:          utils.FileNameFromPath(archive.Path),
+			Size:         archive.Size,
+			SHA256:       archive.SHA256,
+			StorageClass: string(task.StorageClass),
+			Files:        archive.Files,
+			Bytes:        archive.Bytes,
+		})
+	}
+	return manifest
+}
+
+func dbManifestObject(dbKey string, dbZip *types.Archive) *ManifestObject {
+	return &ManifestObject{
+		Key:          dbKey,
+		Size:         dbZip.Size,
+		SHA256:       dbZip.SHA256,
+		StorageClass: string(s3Types.StorageClassStandard),
+	}
+}
+
+// CommitManifest uploads the manifest, the commit point of its run.
+func CommitManifest(task *utils.TaskConfig, manifest *Manifest) error {
+	return uploadJSON(task, ManifestKey(manifest.RunID), manifest)
+}
+
+// DeleteManifest deletes the manifest of a run, which uncommits it.
+func DeleteManifest(task *utils.TaskConfig, runID string) error {
+	return s3.DeleteFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), ManifestKey(runID))
+}
+
+func FetchManifest(task *utils.TaskConfig, runID string) (*Manifest, error) {
+	var manifest Manifest
+	err := fetchJSON(task, ManifestKey(runID), &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// ListCommittedRuns returns the run ids of the task that have a manifest,
+// oldest first.
+func ListCommittedRuns(task *utils.TaskConfig) ([]string, error) {
+	objects, err := s3.ListFilesInS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), manifestPrefix)
+	if err != nil {
+		return nil, err
+	}
+	runIDs := []string{}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		runIDs = append(runIDs, strings.TrimSuffix(strings.TrimPrefix(object.Key, manifestPrefix), ".json"))
+	}
+	sort.Strings(runIDs)
+	return runIDs, nil
+}
+
+// FetchCommittedManifests returns every manifest of the task, oldest first.
+func FetchCommittedManifests(task *utils.TaskConfig) ([]*Manifest, error) {
+	runIDs, err := ListCommittedRuns(task)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []*Manifest{}
+	for _, runID := range runIDs {
+		manifest, err := FetchManifest(task, runID)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
@@ -5,16 +5,19 @@ import (
 	"fmt"
 	"os"
 	"path"
-	lg "s3-diff-archive/logger"
 	"s3-diff-archive/s3"
 	"s3-diff-archive/utils"
+	"strings"
 
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// FetchRegOfTask downloads the reg file of the task. It lists the zips
+// uploaded by runs from before manifests; it is no longer written and only
+// read to restore those zips.
 func FetchRegOfTask(task *utils.TaskConfig) (string, error) {
 	localRegPath := path.Join(task.WorkingDir, fmt.Sprintf("%s-%s.txt", task.ID, utils.RandAndTime(5)))
-	err := s3.DownloadFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), fmt.Sprintf("reg-%s.txt", task.ID), localRegPath)
+	err := s3.DownloadFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), regKey(task), localRegPath, "")
 	if err != nil {
 		if err.Error() == "not-found" {
 			return "", nil
@@ -29,40 +32,27 @@ func FetchRegOfTask(task *utils.TaskConfig) (string, error) {
 	return string(fileStr), nil
 }
 
-func UpdateRegOfTask(task *utils.TaskConfig, newArchived []string) error {
-	if len(newArchived) == 0 {
-		lg.Logs.Info("No new files to update reg file for task %s. Continuing...", task.ID)
-		return nil
-	}
-	lg.Logs.Info("Updating reg file for task %s, new files: %d", task.ID, len(newArchived))
-	reg, err := FetchRegOfTask(task)
-	if err != nil {
-		return err
-	}
-	for _, file := range newArchived {
-		reg += fmt.Sprintf("%s\n", utils.FileNameFromPath(file))
-	}
+func regKey(task *utils.TaskConfig) string {
+	return fmt.Sprintf("reg-%s.txt", task.ID)
+}
 
-	// write to a file
-	filePath := path.Join(task.WorkingDir, fmt.Sprintf("%s-%s.txt", task.ID, utils.RandAndTime(5)))
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	_, err = file.WriteString(reg)
-	if err != nil {
-		return err
-	}
-	file.Close()
+// RegEntry is a line of the reg file: an uploaded zip and its SHA-256.
+type RegEntry struct {
+	Name   string
+	SHA256 string
+}
 
-	err = s3.UploadFileToS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), fmt.Sprintf("reg-%s.txt", task.ID), filePath)
-	if err != nil {
-		return err
+// ParseReg splits a reg file into its entries. Zips registered before
+// checksums were recorded have an empty SHA256.
+func ParseReg(reg string) []RegEntry {
+	entries := []RegEntry{}
+	for _, line := range strings.Split(reg, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, checksum, _ := strings.Cut(line, "\t")
+		entries = append(entries, RegEntry{Name: name, SHA256: checksum})
 	}
-
-	lg.Logs.Info("Reg file updated for task %s", task.ID)
-
-	// remove the file
-	_ = os.Remove(file.Name())
-	return nil
+	return entries
 }
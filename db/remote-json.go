@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/utils"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fetchJSON downloads a small JSON object of the task into v. It returns a
+// "not-found" error when the object does not exist.
+func fetchJSON(task *utils.TaskConfig, key string, v any) error {
+	localPath := path.Join(task.WorkingDir, fmt.Sprintf("%s-%s.json", task.ID, utils.RandAndTime(5)))
+	defer os.Remove(localPath)
+
+	err := s3.DownloadFileFromS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), key, localPath, "")
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+// uploadJSON stores v as a JSON object of the task.
+func uploadJSON(task *utils.TaskConfig, key string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	localPath := path.Join(task.WorkingDir, fmt.Sprintf("%s-%s.json", task.ID, utils.RandAndTime(5)))
+	defer os.Remove(localPath)
+
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return err
+	}
+	return s3.UploadFileToS3(task.CreateS3Config(s3Types.StorageClassStandard), context.TODO(), key, localPath, "")
+}
@@ -11,6 +11,7 @@ require (
 	github.com/bmatcuk/doublestar/v4 v4.9.0
 	github.com/dgraph-io/badger/v4 v4.7.0
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/sys v0.31.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -42,6 +43,5 @@ require (
 	go.opentelemetry.io/otel/trace v1.35.0 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 )
@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"s3-diff-archive/constants"
 	"s3-diff-archive/utils"
 )
 
+// Console is where loggers that print to the console write. Commands that
+// print machine readable output to stdout move it to stderr.
+var Console io.Writer = os.Stdout
+
 // BufferedLogger encapsulates the logging state
 type BufferedLogger struct {
 	logChan        chan string
@@ -83,7 +88,7 @@ func ColoredMessage(level string, message string) string {
 func FormatedLog(logger *BufferedLogger, level string, message string) {
 	toLog := fmt.Sprintf("%s | %s\t| %s", utils.NowTime(), level, message)
 	if logger.printToConsole {
-		fmt.Print(ColoredMessage(level, toLog))
+		fmt.Fprint(Console, ColoredMessage(level, toLog))
 	}
 	Log(logger, toLog)
 }
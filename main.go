@@ -1,17 +1,28 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"path"
 	"s3-diff-archive/archiver"
+	"s3-diff-archive/checker"
+	"s3-diff-archive/collector"
 	"s3-diff-archive/db"
 	lg "s3-diff-archive/logger"
+	"s3-diff-archive/pruner"
+	"s3-diff-archive/repacker"
 	"s3-diff-archive/restorer"
 	"s3-diff-archive/s3"
 	"s3-diff-archive/scanner"
+	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
+	"strings"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 func runArchiner(config *utils.Config) {
@@ -26,35 +37,30 @@ func runArchiner(config *utils.Config) {
 			lg.Logs.Error("%s", err.Error())
 			continue
 		}
-		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, task.Dir, task.StorageClass)
-		refDB := db.FetchRemoteDB(task)
-		defer refDB.Close()
-
-		scannedRes := scanner.ScanTask(refDB.GetDB(), task)
-		archivingSummary += fmt.Sprintf("%s\n", scannedRes.Summary(task.ID).Message())
-		zipPaths := archiver.ArchiveToZip(task, scannedRes)
-		archivingSummary += fmt.Sprintf("Archived %d files to %d zip files\n", len(scannedRes.UpdatedFiles), len(zipPaths))
-
-		writeDB := db.NewDBInDir(task.WorkingDir)
-		writeDB.InsertSfilesToDB(scannedRes.UpdatedFiles)
-		writeDB.InsertSfilesToDB(scannedRes.UnChangedFiles)
-		zippedDBPath, err := writeDB.CloseAndZip(task.Password)
-
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		stats := &archiveStats{}
+		if err := runHook(task, "pre", task.PreHook, stats, nil); err != nil {
+			errors++
+			lg.Logs.Error("Skipping task %s, pre hook failed: %s", task.ID, err.Error())
+			runHook(task, "on_error", task.OnErrorHook, stats, err)
+			continue
+		}
+		summary, err := archiveTaskRecovered(task, stats)
 		if err != nil {
-			lg.Logs.Fatal("%s", err.Error())
+			lg.Logs.Error("Skipping task %s: %s", task.ID, err.Error())
 		}
-
-		uploader := &s3.TaskUploader{
-			Task:          task,
-			ArchivedFiles: zipPaths,
-			DBZipPath:     zippedDBPath,
+		if hookErr := runHook(task, "post", task.PostHook, stats, err); hookErr != nil {
+			lg.Logs.Error("Post hook of task %s failed: %s", task.ID, hookErr.Error())
+			if err == nil {
+				err = hookErr
+			}
 		}
-		err = uploader.UploadAndDelete()
 		if err != nil {
-			lg.Logs.Fatal("%s", err.Error())
+			errors++
+			runHook(task, "on_error", task.OnErrorHook, stats, err)
+			continue
 		}
-		db.UpdateRegOfTask(task, zipPaths)
-		archivingSummary += fmt.Sprintf("%d zips uploaded to S3 for task %s\n", len(zipPaths), task.ID)
+		archivingSummary += summary
 		archivingSummary += "\n---------------------\n"
 	}
 	lg.Logs.Info("Archiver completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
@@ -66,7 +72,239 @@ func runArchiner(config *utils.Config) {
 	}
 }
 
-func runScanner(config *utils.Config) {
+// archiveStats are the numbers of an archive run passed to the hooks of the
+// task.
+type archiveStats struct {
+	RunID     string
+	Updated   int
+	Unchanged int
+	Skipped   int
+	Zips      int
+	Bytes     int64 // size of the uploaded zips
+}
+
+// runHook runs a hook of the task, if it has one, with the context of the run
+// in its environment. runErr is the error the task failed with, if any.
+func runHook(task *utils.TaskConfig, hook, command string, stats *archiveStats, runErr error) error {
+	if command == "" {
+		return nil
+	}
+	status := "success"
+	errMessage := ""
+	if runErr != nil {
+		status = "error"
+		errMessage = runErr.Error()
+	}
+	env := map[string]string{
+		"HOOK":            hook,
+		"TASK_ID":         task.ID,
+		"TASK_DIR":        task.Dir,
+		"TASK_DIRS":       taskDirs(task, string(os.PathListSeparator)),
+		"RUN_ID":          stats.RunID,
+		"STATUS":          status,
+		"ERROR":           errMessage,
+		"FILES_UPDATED":   fmt.Sprint(stats.Updated),
+		"FILES_UNCHANGED": fmt.Sprint(stats.Unchanged),
+		"FILES_SKIPPED":   fmt.Sprint(stats.Skipped),
+		"ZIPS":            fmt.Sprint(stats.Zips),
+		"BYTES":           fmt.Sprint(stats.Bytes),
+	}
+	lg.Logs.Info("Running %s hook of task %s", hook, task.ID)
+	output, err := utils.RunHook(command, task.HookTimeout(), env)
+	if output != "" {
+		lg.Logs.Info("%s hook output:\n%s", hook, output)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s hook: %w", hook, err)
+		if hook == "on_error" {
+			lg.Logs.Error("%s", err.Error())
+		}
+	}
+	return err
+}
+
+// taskDirs lists the dirs of the task, as prefix=path for those archived
+// under a prefix.
+func taskDirs(task *utils.TaskConfig, sep string) string {
+	dirs := []string{}
+	for _, root := range task.Roots() {
+		dirs = append(dirs, root.String())
+	}
+	return strings.Join(dirs, sep)
+}
+
+// archiveTaskRecovered runs archiveTask, returning a panic of the run as an
+// error so the post and on_error hooks of the task still run.
+func archiveTaskRecovered(task *utils.TaskConfig, stats *archiveStats) (summary string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("archive of task %s panicked: %v", task.ID, r)
+		}
+	}()
+	return archiveTask(task, stats)
+}
+
+// archiveTask runs one archive of the task while holding its lock and returns
+// the summary of the run. stats is filled in as the run goes.
+func archiveTask(task *utils.TaskConfig, stats *archiveStats) (string, error) {
+	if task.ObjectLock.Enabled() {
+		err := s3.CheckObjectLock(task.CreateS3Config(task.StorageClass), context.TODO())
+		if err != nil {
+			return "", err
+		}
+	}
+	lock, err := s3.AcquireTaskLock(task.CreateS3Config(task.StorageClass), context.TODO(), task.LockTTL())
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+
+	err = finishPendingUpload(task, lock)
+	if err != nil {
+		return "", fmt.Errorf("failed to resume pending upload: %w", err)
+	}
+	err = s3.AbortStaleUploads(task.CreateS3Config(task.StorageClass), context.TODO())
+	if err != nil {
+		lg.Logs.Warn("%s", err.Error())
+	}
+
+	refDB, err := db.OpenRemoteDB(task)
+	if err != nil {
+		return "", err
+	}
+	defer refDB.Close()
+
+	summary := ""
+	var scannedRes *scanner.ScannedResult
+	var zipPaths []*types.Archive
+	if task.Source == utils.SourceCommand {
+		scannedRes, zipPaths, err = archiver.ArchiveCommand(refDB.GetDB(), task)
+		if err != nil {
+			return "", err
+		}
+		summary += fmt.Sprintf("%s\n", scannedRes.Summary(task.ID).Message())
+	} else {
+		scannedRes = scanner.ScanTask(refDB.GetDB(), task)
+		summary += fmt.Sprintf("%s\n", scannedRes.Summary(task.ID).Message())
+		zipPaths, err = archiver.ArchiveToZip(task, scannedRes)
+		if err != nil {
+			return "", err
+		}
+	}
+	stats.Updated = len(scannedRes.UpdatedFiles) + len(scannedRes.MetaChanged)
+	stats.Unchanged = len(scannedRes.UnChangedFiles)
+	stats.Skipped = len(scannedRes.SkippedFiles)
+	stats.Zips = len(zipPaths)
+	for _, zip := range zipPaths {
+		stats.Bytes += zip.Size
+	}
+	summary += fmt.Sprintf("Archived %d files to %d zip files\n", len(scannedRes.UpdatedFiles), len(zipPaths))
+	inconsistent := []string{}
+	for _, file := range scannedRes.UpdatedFiles {
+		if file.Inconsistent {
+			inconsistent = append(inconsistent, file.RelativePath)
+		}
+	}
+	if len(inconsistent) > 0 {
+		summary += fmt.Sprintf("Inconsistent: %d files changed while they were archived and will be archived again next run: %s\n", len(inconsistent), strings.Join(inconsistent, ", "))
+	}
+
+	writeDB := db.NewDBInDir(task.WorkingDir)
+	writeDB.InsertSfilesToDB(scannedRes.UpdatedFiles)
+	writeDB.InsertSfilesToDB(scannedRes.UnChangedFiles)
+	writeDB.InsertSfilesToDB(scannedRes.MetaChanged)
+	zippedDB, err := writeDB.CloseAndZip(task.Password)
+
+	if err != nil {
+		return "", err
+	}
+
+	runID := utils.NewRunID()
+	stats.RunID = runID
+	uploader := &s3.TaskUploader{
+		Task:          task,
+		RunID:         runID,
+		ArchivedFiles: zipPaths,
+		DBZip:         zippedDB,
+		DBKey:         db.GenerationKey(runID),
+		Changed:       len(scannedRes.UpdatedFiles)+len(scannedRes.MetaChanged) > 0,
+	}
+	err = uploader.Save()
+	if err != nil {
+		return "", err
+	}
+	err = uploader.UploadAndDelete()
+	if err != nil {
+		return "", err
+	}
+	err = commitUpload(task, uploader, lock)
+	if err != nil {
+		return "", err
+	}
+	summary += fmt.Sprintf("%d zips uploaded to S3 for task %s\n", len(zipPaths), task.ID)
+	return summary, nil
+}
+
+// finishPendingUpload completes the upload of a previous archive run of the
+// task that was interrupted, so its zips and DB are not rebuilt from scratch.
+func finishPendingUpload(task *utils.TaskConfig, lock *s3.TaskLock) error {
+	uploader, err := s3.LoadPendingUpload(task)
+	if err != nil || uploader == nil {
+		return err
+	}
+	lg.Logs.Warn("Found an unfinished upload of task %s with %d zips, resuming it", task.ID, len(uploader.ArchivedFiles))
+	err = uploader.UploadAndDelete()
+	if err != nil {
+		return err
+	}
+	err = commitUpload(task, uploader, lock)
+	if err != nil {
+		return err
+	}
+	lg.Logs.Info("Unfinished upload of task %s completed", task.ID)
+	return nil
+}
+
+// commitUpload commits an uploaded run by writing its manifest, then moves the
+// DB pointer to its DB. Until the manifest is written, readers ignore
+// everything the run uploaded. Nothing is committed once the task lock is
+// lost, the run is left pending and resumed by the next archive. If the
+// pointer cannot be moved, the manifest is deleted again and the run is also
+// left pending, so no manifest outlives a failed commit.
+func commitUpload(task *utils.TaskConfig, uploader *s3.TaskUploader, lock *s3.TaskLock) error {
+	if err := lock.Err(); err != nil {
+		return err
+	}
+	if uploader.DBUploaded() {
+		manifest := db.NewManifest(task, uploader.RunID, uploader.ArchivedFiles, uploader.DBZip, uploader.DBKey)
+		err := db.CommitManifest(task, manifest)
+		if err != nil {
+			return err
+		}
+		lg.Logs.Info("Run %s of task %s committed", uploader.RunID, task.ID)
+
+		err = db.SetDBPointer(task, uploader.RunID, uploader.DBZip.SHA256)
+		if err != nil {
+			if deleteErr := db.DeleteManifest(task, uploader.RunID); deleteErr != nil {
+				lg.Logs.Warn("Failed to uncommit run %s of task %s, it is committed by the next archive: %s", uploader.RunID, task.ID, deleteErr.Error())
+			} else {
+				lg.Logs.Info("Run %s of task %s uncommitted, it is committed by the next archive", uploader.RunID, task.ID)
+			}
+			return err
+		}
+	}
+	uploader.Finish()
+
+	err := db.PruneDBHistory(task, task.DBHistory)
+	if err != nil {
+		lg.Logs.Warn("Failed to prune DB history of task %s: %s", task.ID, err.Error())
+	}
+	return nil
+}
+
+// runScanner scans every task. With explain, every skipped path is printed
+// along with the rule that skipped it.
+func runScanner(config *utils.Config, explain bool) {
 	lg.Logs.Info("Scanner started")
 	errors := 0
 	scanSummary := ""
@@ -78,13 +316,30 @@ func runScanner(config *utils.Config) {
 			lg.Logs.Error("%s", err.Error())
 			continue
 		}
-		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, task.Dir, task.StorageClass)
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		if task.Source == utils.SourceCommand {
+			lg.Logs.Info("Task %s archives the output of a command, there is nothing to scan", task.ID)
+			continue
+		}
 		refDB := db.FetchRemoteDB(task)
 		defer refDB.Close()
 
 		scannedRes := scanner.ScanTask(refDB.GetDB(), task)
-		lg.Logs.Info("Scanned %d files in task %s. Skipped %d files, Changed %d files", scannedRes.TotalScanned(), task.ID, len(scannedRes.SkippedFiles), len(scannedRes.UpdatedFiles))
+		lg.Logs.Info("Scanned %d files in task %s. Skipped %d files, Changed %d files, Metadata changed %d files", scannedRes.TotalScanned(), task.ID, len(scannedRes.SkippedFiles), len(scannedRes.UpdatedFiles), len(scannedRes.MetaChanged))
 		scanSummary += fmt.Sprintf("%s\n", scannedRes.Summary(task.ID).Message())
+		for _, total := range scannedRes.SkippedByRule() {
+			message := fmt.Sprintf("Task %s skipped by %s: %d files, %d MB", task.ID, total.Rule, total.Files, total.Bytes/1024/1024)
+			if total.Dirs > 0 {
+				message += fmt.Sprintf(", %d dirs", total.Dirs)
+			}
+			lg.Logs.Info("%s", message)
+			scanSummary += message + "\n"
+		}
+		if explain {
+			for _, skipped := range scannedRes.SkippedFiles {
+				fmt.Printf("%s\tskip %s (%s: %s)\n", task.ID, skipped.RelativePath, skipped.Rule, skipped.Reason)
+			}
+		}
 	}
 	lg.Logs.Info("Scanner completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
 	script, err := utils.Notify(config.NotifyScript, "scan", "success", fmt.Sprintf("Scan Completed. %s\n%s\nTotal Tasks: %d, Errors: %d", utils.NowTime(), scanSummary, len(config.Tasks), errors))
@@ -94,7 +349,12 @@ func runScanner(config *utils.Config) {
 		lg.Logs.Info("Notification sent successfully via script: %s", script)
 	}
 }
-func runRestorer(config *utils.Config) {
+
+// runRestorer restores every task into its dir, or each of its dirs, or
+// into target when it is set. With more than one task, each is restored into
+// a subdir of target named after it. With root, only the dir of each task
+// archived under that prefix is restored.
+func runRestorer(config *utils.Config, target, root string, opts restorer.RestoreOptions) {
 	lg.Logs.Info("Restorer started")
 	errors := 0
 	for i := range config.Tasks {
@@ -105,25 +365,240 @@ func runRestorer(config *utils.Config) {
 			lg.Logs.Error("%s", err.Error())
 			continue
 		}
-		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, task.Dir, task.StorageClass)
-		zips, err := restorer.ExperimentalDownloadArchivedZips(task)
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		taskTarget := target
+		if target != "" && len(config.Tasks) > 1 {
+			taskTarget = path.Join(target, task.ID)
+		}
+		restores := []restorer.RestoreOptions{}
+		switch {
+		case root != "":
+			dir, err := utils.Find(task.Dirs, func(dir utils.Root) bool { return dir.Prefix == root })
+			if err != nil {
+				lg.Logs.Info("Task %s has no dir archived under %s, skipping it", task.ID, root)
+				continue
+			}
+			taskOpts := opts
+			taskOpts.Prefix = root
+			taskOpts.Target = dir.Path
+			if taskTarget != "" {
+				taskOpts.Target = taskTarget
+			}
+			restores = append(restores, taskOpts)
+		case taskTarget != "":
+			// the dirs of the task are laid out under their prefixes
+			taskOpts := opts
+			taskOpts.Target = taskTarget
+			restores = append(restores, taskOpts)
+		case task.Dir == "" && len(task.Dirs) == 0:
+			errors++
+			lg.Logs.Error("Task %s has no dir, restore it with -target", task.ID)
+			continue
+		default:
+			for _, dir := range task.Roots() {
+				taskOpts := opts
+				taskOpts.Prefix = dir.Prefix
+				taskOpts.Target = dir.Path
+				restores = append(restores, taskOpts)
+			}
+		}
+
+		for _, taskOpts := range restores {
+			report, err := restorer.RestoreTask(task, &taskOpts)
+			if err != nil {
+				errors++
+				lg.Logs.Error("%s", err.Error())
+				continue
+			}
+			for _, action := range report.Actions {
+				if opts.DryRun {
+					fmt.Println(action.String())
+				} else if action.Action != restorer.ActionUnchanged {
+					lg.Logs.Info("%s", action.String())
+				}
+			}
+			lg.Logs.Info("%s", report.Message())
+		}
+	}
+	lg.Logs.Info("Restorer completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
+}
+
+func runPruner(config *utils.Config, dryRun bool) {
+	lg.Logs.Info("Pruner started")
+	errors := 0
+	pruneSummary := ""
+	for i := range config.Tasks {
+		lg.Logs.Break()
+		task, err := config.GetTask(config.Tasks[i].ID)
+		if err != nil {
+			errors++
+			lg.Logs.Error("%s", err.Error())
+			continue
+		}
+		if !task.Retention.Enabled() {
+			lg.Logs.Info("Task %s has no retention policy, skipping", task.ID)
+			continue
+		}
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		report, err := pruneTask(task, dryRun)
+		if err != nil {
+			errors++
+			lg.Logs.Error("Failed to prune task %s: %s", task.ID, err.Error())
+			continue
+		}
+		lg.Logs.Info("%s", report.Message())
+		pruneSummary += fmt.Sprintf("%s\n", report.Message())
+	}
+	lg.Logs.Info("Pruner completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
+	script, err := utils.Notify(config.NotifyScript, "prune", "success", fmt.Sprintf("Prune Completed. %s\n%s\nTotal Tasks: %d, Errors: %d", utils.NowTime(), pruneSummary, len(config.Tasks), errors))
+	if err != nil {
+		lg.Logs.Error("Failed to send notification: %v with script: %s", err, script)
+	} else {
+		lg.Logs.Info("Notification sent successfully via script: %s", script)
+	}
+}
+
+// pruneTask prunes the task while holding its lock. A dry run changes
+// nothing and does not lock.
+func pruneTask(task *utils.TaskConfig, dryRun bool) (*pruner.Report, error) {
+	if !dryRun {
+		lock, err := s3.AcquireTaskLock(task.CreateS3Config(task.StorageClass), context.TODO(), task.LockTTL())
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+	}
+	return pruner.PruneTask(task, dryRun)
+}
+
+func runRepacker(config *utils.Config, opts *repacker.Options) {
+	lg.Logs.Info("Repacker started")
+	errors := 0
+	repackSummary := ""
+	for i := range config.Tasks {
+		lg.Logs.Break()
+		task, err := config.GetTask(config.Tasks[i].ID)
+		if err != nil {
+			errors++
+			lg.Logs.Error("%s", err.Error())
+			continue
+		}
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		report, err := repackTask(task, *opts)
+		if err != nil {
+			errors++
+			lg.Logs.Error("Failed to repack task %s: %s", task.ID, err.Error())
+			continue
+		}
+		lg.Logs.Info("%s", report.Message())
+		repackSummary += fmt.Sprintf("%s\n", report.Message())
+	}
+	lg.Logs.Info("Repacker completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
+	script, err := utils.Notify(config.NotifyScript, "repack", "success", fmt.Sprintf("Repack Completed. %s\n%s\nTotal Tasks: %d, Errors: %d", utils.NowTime(), repackSummary, len(config.Tasks), errors))
+	if err != nil {
+		lg.Logs.Error("Failed to send notification: %v with script: %s", err, script)
+	} else {
+		lg.Logs.Info("Notification sent successfully via script: %s", script)
+	}
+}
+
+// repackTask repacks the task while holding its lock. A dry run only
+// reports and does not lock.
+func repackTask(task *utils.TaskConfig, opts repacker.Options) (*repacker.Report, error) {
+	if !opts.DryRun {
+		lock, err := s3.AcquireTaskLock(task.CreateS3Config(task.StorageClass), context.TODO(), task.LockTTL())
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+		opts.Lock = lock
+	}
+	return repacker.RepackTask(task, &opts)
+}
+
+func runCollector(config *utils.Config, opts *collector.Options) {
+	lg.Logs.Info("Garbage collector started")
+	errors := 0
+	gcSummary := ""
+	for i := range config.Tasks {
+		lg.Logs.Break()
+		task, err := config.GetTask(config.Tasks[i].ID)
 		if err != nil {
 			errors++
 			lg.Logs.Error("%s", err.Error())
 			continue
 		}
-		restorePath := path.Join(task.WorkingDir, task.ID, "restored_"+utils.NowTime())
-		_ = os.RemoveAll(restorePath)
-		err = restorer.RestoreFromZips(zips, restorePath, task.Password)
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		report, err := collectTask(task, opts)
+		if err != nil {
+			errors++
+			lg.Logs.Error("Failed to collect garbage of task %s: %s", task.ID, err.Error())
+			continue
+		}
+		lg.Logs.Info("%s", report.Message())
+		gcSummary += fmt.Sprintf("%s\n", report.Message())
+	}
+	lg.Logs.Info("Garbage collector completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
+	script, err := utils.Notify(config.NotifyScript, "gc", "success", fmt.Sprintf("GC Completed. %s\n%s\nTotal Tasks: %d, Errors: %d", utils.NowTime(), gcSummary, len(config.Tasks), errors))
+	if err != nil {
+		lg.Logs.Error("Failed to send notification: %v with script: %s", err, script)
+	} else {
+		lg.Logs.Info("Notification sent successfully via script: %s", script)
+	}
+}
+
+// collectTask collects the garbage of the task, holding its lock when
+// orphans are deleted.
+func collectTask(task *utils.TaskConfig, opts *collector.Options) (*collector.Report, error) {
+	if opts.Delete {
+		lock, err := s3.AcquireTaskLock(task.CreateS3Config(task.StorageClass), context.TODO(), task.LockTTL())
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+	}
+	return collector.CollectTask(task, opts)
+}
+
+// runChecker checks every task and reports whether any of them is damaged.
+func runChecker(config *utils.Config, opts *checker.Options) bool {
+	lg.Logs.Info("Checker started, level: %s", opts.Level)
+	errors := 0
+	damaged := 0
+	checkSummary := ""
+	for i := range config.Tasks {
+		lg.Logs.Break()
+		task, err := config.GetTask(config.Tasks[i].ID)
 		if err != nil {
 			errors++
 			lg.Logs.Error("%s", err.Error())
 			continue
 		}
-		utils.DeleteFils(zips)
-		lg.Logs.Info("Task %s restored in %s", task.ID, restorePath)
+		lg.Logs.Info("Processing task %s, dir: %s, s3 StorageClass: %s", task.ID, taskDirs(task, ", "), task.StorageClass)
+		report, err := checker.CheckTask(task, opts)
+		if err != nil {
+			errors++
+			lg.Logs.Error("Failed to check task %s: %s", task.ID, err.Error())
+			continue
+		}
+		if report.Damaged() {
+			damaged++
+		}
+		lg.Logs.Info("%s", report.Message())
+		checkSummary += fmt.Sprintf("%s\n", report.Message())
 	}
-	lg.Logs.Info("Restorer completed. Total tasks: %d. Error occured: %d", len(config.Tasks), errors)
+	lg.Logs.Info("Checker completed. Total tasks: %d. Damaged: %d. Error occured: %d", len(config.Tasks), damaged, errors)
+	status := "success"
+	if damaged > 0 || errors > 0 {
+		status = "failed"
+	}
+	script, err := utils.Notify(config.NotifyScript, "check", status, fmt.Sprintf("Check Completed. %s\n%s\nTotal Tasks: %d, Damaged: %d, Errors: %d", utils.NowTime(), checkSummary, len(config.Tasks), damaged, errors))
+	if err != nil {
+		lg.Logs.Error("Failed to send notification: %v with script: %s", err, script)
+	} else {
+		lg.Logs.Info("Notification sent successfully via script: %s", script)
+	}
+	return damaged == 0 && errors == 0
 }
 
 func main() {
@@ -144,6 +619,22 @@ func main() {
 		runRestoreCommand()
 	case "view":
 		runViewCommand()
+	case "rollback":
+		runRollbackCommand()
+	case "unlock":
+		runUnlockCommand()
+	case "prune":
+		runPruneCommand()
+	case "repack":
+		runRepackCommand()
+	case "gc":
+		runGCCommand()
+	case "check":
+		runCheckCommand()
+	case "verify":
+		runVerifyCommand()
+	case "diff":
+		runDiffCommand()
 	default:
 		fmt.Printf("Unknown command: %s\n\n", command)
 		printUsage()
@@ -159,6 +650,14 @@ func printUsage() {
 	fmt.Println("  archive  - Archive changed files to S3")
 	fmt.Println("  restore  - Restore files from S3")
 	fmt.Println("  view     - View database for a specific task")
+	fmt.Println("  rollback - List or roll back the DB history of a task")
+	fmt.Println("  unlock   - Show or remove the lock of a task")
+	fmt.Println("  prune    - Remove runs outside the retention policy of each task")
+	fmt.Println("  repack   - Rewrite zips that hold mostly superseded files")
+	fmt.Println("  gc       - Find objects nothing references and references to missing objects")
+	fmt.Println("  check    - Verify that the backups in the bucket are restorable")
+	fmt.Println("  verify   - Compare the live dir of a task with its backup")
+	fmt.Println("  diff     - List the files that changed between two archive runs")
 	fmt.Println("")
 	fmt.Println("Use 's3-diff-archive <command> -h' for command-specific help")
 }
@@ -167,6 +666,8 @@ func runScanCommand() {
 	fs := flag.NewFlagSet("scan", flag.ExitOnError)
 	configPath := fs.String("config", "", "Path to configuration file (required)")
 	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	explain := fs.Bool("explain", false, "Print every skipped path with the rule that skipped it")
 
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Usage: %s scan [flags]\n\n", os.Args[0])
@@ -184,8 +685,9 @@ func runScanCommand() {
 	}
 
 	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
 	initLoggersAndRun(config, func() {
-		runScanner(config)
+		runScanner(config, *explain)
 	})
 }
 
@@ -193,6 +695,7 @@ func runArchiveCommand() {
 	fs := flag.NewFlagSet("archive", flag.ExitOnError)
 	configPath := fs.String("config", "", "Path to configuration file (required)")
 	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
 
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Usage: %s archive [flags]\n\n", os.Args[0])
@@ -210,6 +713,7 @@ func runArchiveCommand() {
 	}
 
 	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
 	initLoggersAndRun(config, func() {
 		runArchiner(config)
 	})
@@ -219,10 +723,16 @@ func runRestoreCommand() {
 	fs := flag.NewFlagSet("restore", flag.ExitOnError)
 	configPath := fs.String("config", "", "Path to configuration file (required)")
 	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	target := fs.String("target", "", "Dir to restore into, defaults to the dir of each task")
+	onConflict := fs.String("on-conflict", restorer.ConflictSkip, "What to do with files that exist in the target: skip, overwrite, newer or rename")
+	dryRun := fs.Bool("dry-run", false, "List the actions without restoring anything")
+	mirror := fs.Bool("mirror", false, "Delete files of the target that are not in the backup")
+	root := fs.String("root", "", "Only restore the dir of each task archived under this prefix, for tasks with several dirs")
 
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Usage: %s restore [flags]\n\n", os.Args[0])
-		fmt.Fprintf(fs.Output(), "Restore files from S3\n\n")
+		fmt.Fprintf(fs.Output(), "Restore the current files of every task from S3 into its dir, or into -target\n\n")
 		fmt.Fprintf(fs.Output(), "Flags:\n")
 		fs.PrintDefaults()
 	}
@@ -235,9 +745,17 @@ func runRestoreCommand() {
 		os.Exit(1)
 	}
 
+	switch *onConflict {
+	case restorer.ConflictSkip, restorer.ConflictOverwrite, restorer.ConflictNewer, restorer.ConflictRename:
+	default:
+		fmt.Println("Error: -on-conflict must be skip, overwrite, newer or rename")
+		os.Exit(1)
+	}
+
 	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
 	initLoggersAndRun(config, func() {
-		runRestorer(config)
+		runRestorer(config, *target, *root, restorer.RestoreOptions{OnConflict: *onConflict, DryRun: *dryRun, Mirror: *mirror})
 	})
 }
 
@@ -245,11 +763,11 @@ func runViewCommand() {
 	fs := flag.NewFlagSet("view", flag.ExitOnError)
 	configPath := fs.String("config", "", "Path to configuration file (required)")
 	envPath := fs.String("env", ".env", "Path to environment file")
-	taskId := fs.String("task", "", "Task ID to view (required)")
+	selection := addTaskSelectionFlags(fs)
 
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Usage: %s view [flags]\n\n", os.Args[0])
-		fmt.Fprintf(fs.Output(), "View database for a specific task\n\n")
+		fmt.Fprintf(fs.Output(), "View the database of each task\n\n")
 		fmt.Fprintf(fs.Output(), "Flags:\n")
 		fs.PrintDefaults()
 	}
@@ -262,18 +780,445 @@ func runViewCommand() {
 		os.Exit(1)
 	}
 
-	if *taskId == "" {
-		fmt.Println("Error: -task flag is required")
+	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
+	for i := range config.Tasks {
+		task, err := config.GetTask(config.Tasks[i].ID)
+		if err != nil {
+			panic(err)
+		}
+		db.ViewDB(task)
+	}
+}
+
+func runRollbackCommand() {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	to := fs.String("to", "", "Run ID to roll back to (default: the run before the current one)")
+	list := fs.Bool("list", false, "List the DB history instead of rolling back")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rollback [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "List or roll back the DB history of a task. The next archive run is computed against the rolled back DB\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	taskId := selection.single(fs)
+
+	config := utils.GetConfig(*configPath, *envPath)
+	task, err := config.GetTask(taskId)
+	if err != nil {
+		panic(err)
+	}
+	initLoggersAndRun(config, func() {
+		if *list {
+			listDBHistory(task)
+			return
+		}
+		lock, err := s3.AcquireTaskLock(task.CreateS3Config(task.StorageClass), context.TODO(), task.LockTTL())
+		if err != nil {
+			lg.Logs.Fatal("%s", err.Error())
+		}
+		defer lock.Release()
+		generation, err := db.RollbackDB(task, *to)
+		if err != nil {
+			lg.Logs.Fatal("%s", err.Error())
+		}
+		lg.Logs.Info("Task %s rolled back to the DB of run %s", task.ID, generation.RunID)
+	})
+}
+
+func runUnlockCommand() {
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	force := fs.Bool("force", false, "Remove the lock even if it is held by a running process")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s unlock [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Show the lock of a task, or remove it with -force after its holder died\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	taskId := selection.single(fs)
+
+	config := utils.GetConfig(*configPath, *envPath)
+	task, err := config.GetTask(taskId)
+	if err != nil {
+		panic(err)
+	}
+	s3Config := task.CreateS3Config(task.StorageClass)
+	lock, err := s3.FetchTaskLock(s3Config, context.TODO())
+	if err != nil {
+		if err.Error() == "not-found" {
+			fmt.Printf("Task %s is not locked\n", task.ID)
+			return
+		}
+		panic(err)
+	}
+	fmt.Printf("Task %s is locked by %s\n", task.ID, lock.String())
+	if !*force {
+		fmt.Println("Use -force to remove the lock")
+		os.Exit(1)
+	}
+	err = s3.ForceUnlockTask(s3Config, context.TODO())
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Lock of task %s removed\n", task.ID)
+}
+
+func runPruneCommand() {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Report what would be removed without removing it")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s prune [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Remove runs outside the retention policy of each task and delete zips no kept run references\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
+	initLoggersAndRun(config, func() {
+		runPruner(config, *dryRun)
+	})
+}
+
+func runRepackCommand() {
+	fs := flag.NewFlagSet("repack", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	threshold := fs.Float64("threshold", 0.5, "Repack zips whose share of live data is below this (0-1)")
+	dryRun := fs.Bool("dry-run", false, "Report which zips would be repacked without changing anything")
+	restoreTier := fs.String("restore-tier", string(s3Types.TierBulk), "Tier of restores requested for GLACIER and DEEP_ARCHIVE zips: Bulk, Standard or Expedited")
+	restoreDays := fs.Int("restore-days", 7, "Days a restored copy of a cold zip stays available")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s repack [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Rewrite the live entries of zips that hold mostly superseded files into new zips and delete the old ones\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *threshold <= 0 || *threshold > 1 {
+		fmt.Println("Error: -threshold must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	tier := s3Types.Tier(*restoreTier)
+	if tier != s3Types.TierBulk && tier != s3Types.TierStandard && tier != s3Types.TierExpedited {
+		fmt.Println("Error: -restore-tier must be Bulk, Standard or Expedited")
+		os.Exit(1)
+	}
+
+	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
+	initLoggersAndRun(config, func() {
+		runRepacker(config, &repacker.Options{
+			Threshold:   *threshold,
+			DryRun:      *dryRun,
+			RestoreTier: tier,
+			RestoreDays: int32(*restoreDays),
+		})
+	})
+}
+
+func runGCCommand() {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	deleteOrphans := fs.Bool("delete", false, "Delete unreferenced objects older than the grace period")
+	grace := fs.Duration("grace", 7*24*time.Hour, "Unreferenced objects younger than this are never deleted")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gc [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Report objects of each task that nothing references and references to missing objects\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
+	initLoggersAndRun(config, func() {
+		runCollector(config, &collector.Options{Delete: *deleteOrphans, Grace: *grace})
+	})
+}
+
+func runCheckCommand() {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	level := fs.String("level", checker.LevelQuick, "quick: confirm every object exists with the expected size and storage class. full: also download and verify zips")
+	percent := fs.Int("percent", 100, "Percentage of the zips of each task a full check downloads")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Verify that the backups in the bucket are restorable. Exits with 1 if any task is damaged\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *level != checker.LevelQuick && *level != checker.LevelFull {
+		fmt.Println("Error: -level must be quick or full")
+		os.Exit(1)
+	}
+
+	if *percent < 1 || *percent > 100 {
+		fmt.Println("Error: -percent must be between 1 and 100")
+		os.Exit(1)
+	}
+
+	config := utils.GetConfig(*configPath, *envPath)
+	selection.apply(config)
+	healthy := true
+	initLoggersAndRun(config, func() {
+		healthy = runChecker(config, &checker.Options{Level: *level, Percent: *percent})
+	})
+	if !healthy {
+		os.Exit(1)
+	}
+}
+
+func runVerifyCommand() {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	restored := fs.String("restored", "", "Compare with this restored tree instead of the remote DB, laid out like restore -target")
+	format := fs.String("format", "text", "Output format: text or json")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "List every path added, modified, deleted or changed in type in the live dirs of each task since its last archive. Exits with 1 if there are differences\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
 		fs.Usage()
 		os.Exit(1)
 	}
 
+	if *format != "text" && *format != "json" {
+		fmt.Println("Error: -format must be text or json")
+		os.Exit(1)
+	}
+
 	config := utils.GetConfig(*configPath, *envPath)
-	task, err := config.GetTask(*taskId)
+	selection.apply(config)
+	if *format == "json" {
+		// keep stdout for the report
+		lg.Console = os.Stderr
+	}
+	reports := []*restorer.VerifyReport{}
+	errors := 0
+	initLoggersAndRun(config, func() {
+		for i := range config.Tasks {
+			task, err := config.GetTask(config.Tasks[i].ID)
+			if err != nil {
+				errors++
+				lg.Logs.Error("%s", err.Error())
+				continue
+			}
+			if task.Source == utils.SourceCommand {
+				lg.Logs.Info("Task %s archives the output of a command, there is nothing to verify", task.ID)
+				continue
+			}
+			restoredDir := *restored
+			if restoredDir != "" && len(config.Tasks) > 1 {
+				restoredDir = path.Join(restoredDir, task.ID)
+			}
+			report, err := restorer.VerifyTask(task, restoredDir)
+			if err != nil {
+				errors++
+				lg.Logs.Error("%s", err.Error())
+				continue
+			}
+			lg.Logs.Info("%s", report.Message())
+			reports = append(reports, report)
+		}
+	})
+
+	changed := false
+	for _, report := range reports {
+		changed = changed || len(report.Changes) > 0
+	}
+	switch {
+	case *format == "json" && len(config.Tasks) == 1 && len(reports) == 1:
+		printJSON(reports[0])
+	case *format == "json":
+		printJSON(reports)
+	default:
+		for _, report := range reports {
+			for _, change := range report.Changes {
+				if len(config.Tasks) > 1 {
+					fmt.Printf("%s\t", report.TaskID)
+				}
+				fmt.Println(change.String())
+			}
+		}
+	}
+	if changed || errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func runDiffCommand() {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (required)")
+	envPath := fs.String("env", ".env", "Path to environment file")
+	selection := addTaskSelectionFlags(fs)
+	format := fs.String("format", "text", "Output format: text or json")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] <runA> <runB>\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "List the files added, modified, deleted and moved between two archive runs, see 'rollback -list' for run IDs\n\n")
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(os.Args[2:])
+
+	if *configPath == "" {
+		fmt.Println("Error: -config flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	taskId := selection.single(fs)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Error: two run IDs are required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if *format != "text" && *format != "json" {
+		fmt.Println("Error: -format must be text or json")
+		os.Exit(1)
+	}
+
+	config := utils.GetConfig(*configPath, *envPath)
+	task, err := config.GetTask(taskId)
+	if err != nil {
+		panic(err)
+	}
+	if *format == "json" {
+		// keep stdout for the report
+		lg.Console = os.Stderr
+	}
+	var diff *restorer.RunDiff
+	initLoggersAndRun(config, func() {
+		diff, err = restorer.DiffRuns(task, fs.Arg(0), fs.Arg(1))
+		if err != nil {
+			lg.Logs.Fatal("%s", err.Error())
+		}
+		lg.Logs.Info("%s", diff.Message())
+	})
+
+	if *format == "json" {
+		printJSON(diff)
+		return
+	}
+	for _, change := range diff.Changes {
+		fmt.Printf("%s\t%+d\n", change.String(), change.SizeDelta)
+	}
+	fmt.Println("")
+	fmt.Printf("%-30s %8s %8s %8s %8s %16s %16s\n", "DIR", "ADDED", "MODIFIED", "DELETED", "MOVED", "SIZE DELTA", "ARCHIVED")
+	for _, dir := range diff.Dirs {
+		fmt.Printf("%-30s %8d %8d %8d %8d %16d %16d\n", dir.Dir, dir.Added, dir.Modified, dir.Deleted, dir.Moved, dir.SizeDelta, dir.Archived)
+	}
+	fmt.Printf("%-30s %8s %8s %8s %8s %16d %16d\n", "TOTAL", "", "", "", "", diff.SizeDelta, diff.Archived)
+}
+
+func printJSON(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		panic(err)
 	}
-	db.ViewDB(task)
+	fmt.Println(string(data))
+}
+
+func listDBHistory(task *utils.TaskConfig) {
+	generations, err := db.ListDBHistory(task)
+	if err != nil {
+		lg.Logs.Fatal("%s", err.Error())
+	}
+	pointer, err := db.FetchDBPointer(task)
+	if err != nil {
+		lg.Logs.Fatal("%s", err.Error())
+	}
+	for _, generation := range generations {
+		marker := " "
+		if pointer != nil && pointer.RunID == generation.RunID {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\t%d bytes\t%s\n", marker, generation.RunID, generation.Size, generation.LastModified.Format("2006-01-02 15:04:05"))
+	}
 }
 
 func initLoggersAndRun(config *utils.Config, runFunc func()) {
@@ -283,6 +1228,12 @@ func initLoggersAndRun(config *utils.Config, runFunc func()) {
 	}
 	defer lg.CloseGlobalLoggers()
 
+	unlock, err := utils.LockWorkingDir(config.WorkingDir)
+	if err != nil {
+		lg.Logs.Fatal("%s", err.Error())
+	}
+	defer unlock()
+
 	lg.Logs.Info("S3 Bucket: %s", config.S3Bucket)
 	lg.Logs.Info("S3 BasePath: %s", config.S3BasePath)
 	lg.Logs.Info("S3 Max Zip Size: %d", config.MaxZipSize)
@@ -293,3 +1244,60 @@ func initLoggersAndRun(config *utils.Config, runFunc func()) {
 
 	runFunc()
 }
+
+// taskList is a flag that can be given several times, each time with one ID
+// or a comma separated list of them.
+type taskList []string
+
+func (l *taskList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *taskList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// taskSelection holds the flags that pick the tasks a command runs on.
+type taskSelection struct {
+	tasks    taskList
+	excluded taskList
+	tags     taskList
+}
+
+func addTaskSelectionFlags(fs *flag.FlagSet) *taskSelection {
+	selection := &taskSelection{}
+	fs.Var(&selection.tasks, "task", "Only run this task, can be repeated (default: all tasks)")
+	fs.Var(&selection.excluded, "exclude-task", "Skip this task, can be repeated")
+	fs.Var(&selection.tags, "tag", "Only run the tasks with this tag, can be repeated")
+	return selection
+}
+
+// single returns the task of a command that runs on one task, and exits when
+// the flags do not name exactly one.
+func (s *taskSelection) single(fs *flag.FlagSet) string {
+	if len(s.tasks) == 0 && len(s.excluded) == 0 && len(s.tags) == 0 {
+		fmt.Println("Error: -task flag is required")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(s.tasks) != 1 || len(s.excluded) > 0 || len(s.tags) > 0 {
+		fmt.Printf("Error: %s runs on one task, give it a single -task and no -exclude-task or -tag\n", fs.Name())
+		os.Exit(1)
+	}
+	return s.tasks[0]
+}
+
+// apply drops the tasks that are not selected from the config, so the run
+// loops only see the selected ones.
+func (s *taskSelection) apply(config *utils.Config) {
+	err := config.SelectTasks(s.tasks, s.excluded, s.tags)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
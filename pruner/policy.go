@@ -0,0 +1,61 @@
+package pruner
+
+import (
+	"fmt"
+	"s3-diff-archive/utils"
+	"time"
+)
+
+// retentionRule keeps the latest run of each of the most recent count
+// periods, a period being the runs that share a bucket key.
+type retentionRule struct {
+	name   string
+	count  int
+	bucket func(time.Time) string
+}
+
+func retentionRules(policy utils.Retention) []retentionRule {
+	return []retentionRule{
+		{"last", policy.KeepLast, func(t time.Time) string { return t.String() }},
+		{"daily", policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", policy.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// keptRuns applies the policy to runIDs, oldest first, and returns the runs
+// it keeps with the rules that keep each of them. Runs whose id is not a
+// timestamp are always kept.
+func keptRuns(policy utils.Retention, runIDs []string) map[string][]string {
+	kept := map[string][]string{}
+	for _, rule := range retentionRules(policy) {
+		if rule.count <= 0 {
+			continue
+		}
+		lastBucket := ""
+		count := 0
+		for i := len(runIDs) - 1; i >= 0 && count < rule.count; i-- {
+			runTime, err := utils.RunTime(runIDs[i])
+			if err != nil {
+				continue
+			}
+			bucket := rule.bucket(runTime)
+			if bucket == lastBucket {
+				continue
+			}
+			lastBucket = bucket
+			count++
+			kept[runIDs[i]] = append(kept[runIDs[i]], rule.name)
+		}
+	}
+	for _, runID := range runIDs {
+		if _, err := utils.RunTime(runID); err != nil {
+			kept[runID] = append(kept[runID], "unknown date")
+		}
+	}
+	return kept
+}
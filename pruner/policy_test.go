@@ -0,0 +1,112 @@
+package pruner
+
+import (
+	"reflect"
+	"s3-diff-archive/utils"
+	"testing"
+)
+
+func TestKeptRuns(t *testing.T) {
+	// oldest first, across a day, an ISO week, a month and a year boundary
+	runs := []string{
+		"2024_12_29_10_00_00", // Sunday, week 2024-W52
+		"2024_12_30_09_00_00", // Monday, week 2025-W01
+		"2024_12_31_23_59_59", // last run of 2024
+		"manual",              // not a timestamp
+		"2025_01_01_00_00_00", // first run of 2025
+		"2025_01_01_12_00_00",
+		"2025_01_05_23_59_59", // Sunday, still 2025-W01
+		"2025_01_06_00_00_00", // Monday, 2025-W02
+	}
+
+	tests := []struct {
+		name   string
+		policy utils.Retention
+		kept   map[string][]string
+	}{
+		{
+			name:   "no rules keeps only undated runs",
+			policy: utils.Retention{},
+			kept:   map[string][]string{"manual": {"unknown date"}},
+		},
+		{
+			name:   "last",
+			policy: utils.Retention{KeepLast: 2},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"last"},
+				"2025_01_05_23_59_59": {"last"},
+				"manual":              {"unknown date"},
+			},
+		},
+		{
+			name:   "daily keeps the latest run of a day, across midnight",
+			policy: utils.Retention{KeepDaily: 4},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"daily"},
+				"2025_01_05_23_59_59": {"daily"},
+				"2025_01_01_12_00_00": {"daily"},
+				"2024_12_31_23_59_59": {"daily"},
+				"manual":              {"unknown date"},
+			},
+		},
+		{
+			name:   "weekly follows ISO weeks across the year",
+			policy: utils.Retention{KeepWeekly: 3},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"weekly"},
+				"2025_01_05_23_59_59": {"weekly"},
+				"2024_12_29_10_00_00": {"weekly"},
+				"manual":              {"unknown date"},
+			},
+		},
+		{
+			name:   "monthly",
+			policy: utils.Retention{KeepMonthly: 2},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"monthly"},
+				"2024_12_31_23_59_59": {"monthly"},
+				"manual":              {"unknown date"},
+			},
+		},
+		{
+			name:   "yearly with fewer years than its count",
+			policy: utils.Retention{KeepYearly: 5},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"yearly"},
+				"2024_12_31_23_59_59": {"yearly"},
+				"manual":              {"unknown date"},
+			},
+		},
+		{
+			name:   "overlapping rules keep a run once, listing each rule",
+			policy: utils.Retention{KeepLast: 1, KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 2},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"last", "daily", "weekly", "monthly"},
+				"2025_01_05_23_59_59": {"daily", "weekly"},
+				"2024_12_31_23_59_59": {"monthly"},
+				"manual":              {"unknown date"},
+			},
+		},
+		{
+			name:   "counts larger than the history keep every period",
+			policy: utils.Retention{KeepDaily: 100},
+			kept: map[string][]string{
+				"2025_01_06_00_00_00": {"daily"},
+				"2025_01_05_23_59_59": {"daily"},
+				"2025_01_01_12_00_00": {"daily"},
+				"2024_12_31_23_59_59": {"daily"},
+				"2024_12_30_09_00_00": {"daily"},
+				"2024_12_29_10_00_00": {"daily"},
+				"manual":              {"unknown date"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept := keptRuns(test.policy, runs)
+			if !reflect.DeepEqual(kept, test.kept) {
+				t.Errorf("kept %v, want %v", kept, test.kept)
+			}
+		})
+	}
+}
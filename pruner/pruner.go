@@ -0,0 +1,204 @@
+package pruner
+
+import (
+	"context"
+	"fmt"
+	"s3-diff-archive/db"
+	lg "s3-diff-archive/logger"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"strings"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DeferredZip is an unreferenced zip that is kept until its minimum storage
+// duration has passed, so deleting it is not billed as an early deletion.
+type DeferredZip struct {
+	Zip   *db.ManifestObject
+	Until time.Time
+}
+
+type Report struct {
+	TaskID       string
+	DryRun       bool
+	KeptRuns     map[string][]string // run id to the rules that keep it
+	PrunedRuns   []string
+	DeletedZips  []*db.ManifestObject
+	DeferredZips []*DeferredZip
+}
+
+func (r *Report) FreedBytes() int64 {
+	var size int64
+	for _, zip := range r.DeletedZips {
+		size += zip.Size
+	}
+	return size
+}
+
+func (r *Report) Message() string {
+	prefix := ""
+	if r.DryRun {
+		prefix = "[dry run] "
+	}
+	return fmt.Sprintf("%sTask: %s, Runs kept: %d, Runs pruned: %d, Zips deleted: %d (%d MB), Zips deferred: %d",
+		prefix, r.TaskID, len(r.KeptRuns), len(r.PrunedRuns), len(r.DeletedZips), r.FreedBytes()/1024/1024, len(r.DeferredZips))
+}
+
+// PruneTask removes the runs of the task that fall outside its retention
+// policy. Their DBs are deleted, along with every zip of theirs that no kept
+// DB references. The current run and the latest run are always kept. Zips
+// still inside their minimum storage duration are left for a later prune.
+//
+// Zips of legacy runs from before manifests are never deleted, since the
+// files in them cannot be attributed.
+func PruneTask(task *utils.TaskConfig, dryRun bool) (*Report, error) {
+	report := &Report{TaskID: task.ID, DryRun: dryRun, KeptRuns: map[string][]string{}}
+
+	snapshots, err := db.ListSnapshots(task)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		lg.Logs.Info("Task %s has no runs to prune", task.ID)
+		return report, nil
+	}
+	runIDs := []string{}
+	hasDB := map[string]bool{}
+	for _, snapshot := range snapshots {
+		runIDs = append(runIDs, snapshot.RunID)
+		hasDB[snapshot.RunID] = true
+	}
+
+	report.KeptRuns = keptRuns(task.Retention, runIDs)
+	latest := runIDs[len(runIDs)-1]
+	report.KeptRuns[latest] = append(report.KeptRuns[latest], "latest")
+	current, err := db.CurrentDB(task)
+	if err != nil {
+		return nil, err
+	}
+	if current.RunID != "" {
+		report.KeptRuns[current.RunID] = append(report.KeptRuns[current.RunID], "current")
+	}
+	for _, runID := range runIDs {
+		if rules, ok := report.KeptRuns[runID]; ok {
+			lg.Logs.Info("Keeping run %s (%s)", runID, strings.Join(rules, ", "))
+		}
+	}
+
+	referenced, err := referencedArchives(task, report.KeptRuns)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests, err := db.FetchCommittedManifests(task)
+	if err != nil {
+		return nil, err
+	}
+	hasManifest := map[string]bool{}
+	now := time.Now()
+	for _, manifest := range manifests {
+		hasManifest[manifest.RunID] = true
+		if _, ok := report.KeptRuns[manifest.RunID]; ok {
+			continue
+		}
+		if !manifest.Pruned() && manifest.DB != nil {
+			report.PrunedRuns = append(report.PrunedRuns, manifest.RunID)
+		}
+
+		remaining := []*db.ManifestObject{}
+		for _, zip := range manifest.Archives {
+			if referenced[zip.Key] {
+				remaining = append(remaining, zip)
+				continue
+			}
+			until := s3.EarliestFreeDeletion(s3Types.StorageClass(zip.StorageClass), manifest.CreatedAt)
+			if now.Before(until) {
+				lg.Logs.Info("Deferring deletion of %s (%s) until %s", zip.Key, zip.StorageClass, until.Format("2006-01-02"))
+				report.DeferredZips = append(report.DeferredZips, &DeferredZip{Zip: zip, Until: until})
+				remaining = append(remaining, zip)
+				continue
+			}
+			lg.Logs.Info("Deleting zip %s, %d bytes", zip.Key, zip.Size)
+			if !dryRun {
+				err := s3.DeleteFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), zip.Key)
+				if err != nil {
+					lg.Logs.Warn("%s", err.Error())
+					remaining = append(remaining, zip)
+					continue
+				}
+			}
+			report.DeletedZips = append(report.DeletedZips, zip)
+		}
+
+		if dryRun || (manifest.Pruned() && len(remaining) == len(manifest.Archives)) {
+			continue
+		}
+		if manifest.Kind == db.RunKindRepack && len(remaining) == len(manifest.Archives) {
+			// a repack has no DB to prune, its manifest is only rewritten
+			// once one of its zips is deleted
+			continue
+		}
+		if hasDB[manifest.RunID] {
+			lg.Logs.Info("Deleting DB of run %s", manifest.RunID)
+			err := db.DeleteDBGeneration(task, manifest.RunID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !manifest.Pruned() {
+			prunedAt := time.Now().UTC()
+			manifest.PrunedAt = &prunedAt
+		}
+		manifest.DB = nil
+		manifest.Archives = remaining
+		err := db.CommitManifest(task, manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// legacy runs have a DB but no manifest
+	for _, runID := range runIDs {
+		if _, ok := report.KeptRuns[runID]; ok || hasManifest[runID] {
+			continue
+		}
+		report.PrunedRuns = append(report.PrunedRuns, runID)
+		lg.Logs.Info("Deleting DB of legacy run %s", runID)
+		if !dryRun {
+			err := db.DeleteDBGeneration(task, runID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if task.ObjectLock.Enabled() && len(report.DeletedZips) > 0 {
+		lg.Logs.Warn("Task %s uses Object Lock, deleted zips stay stored as noncurrent versions until their retention ends", task.ID)
+	}
+	return report, nil
+}
+
+// referencedArchives returns the zips referenced by the DB of any kept run.
+func referencedArchives(task *utils.TaskConfig, kept map[string][]string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	for runID := range kept {
+		refDB, err := db.FetchDBOfRun(task, runID)
+		if err != nil {
+			return nil, err
+		}
+		err = refDB.ForEachSfile(func(file *types.SFile) error {
+			if file.Archive != "" {
+				referenced[file.Archive] = true
+			}
+			return nil
+		})
+		refDB.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
@@ -0,0 +1,365 @@
+package repacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"s3-diff-archive/archiver"
+	"s3-diff-archive/db"
+	lg "s3-diff-archive/logger"
+	"s3-diff-archive/s3"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"sort"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type Options struct {
+	Threshold   float64 // zips whose live ratio is below it are repacked
+	DryRun      bool
+	RestoreTier s3Types.Tier // tier of restores requested for cold zips
+	RestoreDays int32        // days a restored copy stays available
+	Lock        *s3.TaskLock // checked before the repack is committed, nil in dry runs
+}
+
+// Candidate is a zip selected for repacking.
+type Candidate struct {
+	Zip       *db.ManifestObject
+	RunID     string           // run that uploaded the zip
+	Live      map[string]int64 // live entries to their size
+	LiveBytes int64
+}
+
+// Ratio is the share of the uncompressed data of the zip that is still live.
+func (c *Candidate) Ratio() float64 {
+	return float64(c.LiveBytes) / float64(c.Zip.Bytes)
+}
+
+type Report struct {
+	TaskID   string
+	DryRun   bool
+	Repacked []*Candidate
+	Deferred map[string]string // zip to why it was not repacked yet
+	NewZips  []*types.Archive
+}
+
+func (r *Report) FreedBytes() int64 {
+	var size int64
+	for _, candidate := range r.Repacked {
+		size += candidate.Zip.Size
+	}
+	for _, zip := range r.NewZips {
+		size -= zip.Size
+	}
+	return size
+}
+
+func (r *Report) Message() string {
+	prefix := ""
+	if r.DryRun {
+		prefix = "[dry run] "
+	}
+	return fmt.Sprintf("%sTask: %s, Zips repacked: %d into %d (%d MB freed), Zips deferred: %d",
+		prefix, r.TaskID, len(r.Repacked), len(r.NewZips), r.FreedBytes()/1024/1024, len(r.Deferred))
+}
+
+// RepackTask rewrites the live entries of zips whose live ratio is below the
+// threshold into new zips, points every DB of the task at the new zips and
+// deletes the old ones. A live entry is one referenced by the DB of any run
+// that can still be restored.
+//
+// Zips still inside their minimum storage duration are left alone, since
+// deleting them is billed as if they were stored for the full duration. Zips
+// in GLACIER or DEEP_ARCHIVE cannot be downloaded directly; a restore is
+// requested for them and they are repacked by a later run once it completes.
+// Zips without recorded entry stats, uploaded before they were recorded, and
+// zips without any live entry, which prune deletes, are not repacked.
+func RepackTask(task *utils.TaskConfig, opts *Options) (*Report, error) {
+	report := &Report{TaskID: task.ID, DryRun: opts.DryRun, Deferred: map[string]string{}}
+
+	// a pending run was computed against the current DBs, repacking would
+	// leave it pointing at deleted zips
+	pending, err := s3.LoadPendingUpload(task)
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("task %s has an unfinished upload, run archive first", task.ID)
+	}
+
+	snapshots, err := db.ListSnapshots(task)
+	if err != nil {
+		return nil, err
+	}
+	live, err := liveEntries(task, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := selectCandidates(task, opts, live, report)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun || len(candidates) == 0 {
+		report.Repacked = candidates
+		return report, nil
+	}
+
+	runID := utils.NewRunID()
+	workDir := path.Join(task.WorkingDir, task.ID, "repack-"+runID)
+	defer os.RemoveAll(workDir)
+
+	for i, candidate := range candidates {
+		err := extractLive(task, candidate, path.Join(workDir, fmt.Sprint(i)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	archives, relocated, err := rezip(task, candidates, workDir)
+	if err != nil {
+		return nil, err
+	}
+	report.NewZips = archives
+
+	for _, archive := range archives {
+		err := s3.UploadFileToS3(task.CreateS3Config(task.StorageClass), context.TODO(), utils.FileNameFromPath(archive.Path), archive.Path, archive.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		_ = os.Remove(archive.Path)
+	}
+
+	if opts.Lock != nil {
+		if err := opts.Lock.Err(); err != nil {
+			return nil, err
+		}
+	}
+	manifest := db.NewManifest(task, runID, archives, nil, "")
+	manifest.Kind = db.RunKindRepack
+	err = db.CommitManifest(task, manifest)
+	if err != nil {
+		return nil, err
+	}
+	lg.Logs.Info("Repack %s of task %s committed with %d zips", runID, task.ID, len(archives))
+
+	for _, snapshot := range snapshots {
+		refDB, err := db.FetchDBOfRun(task, snapshot.RunID)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := refDB.UpdateSfiles(func(file *types.SFile) bool {
+			newZip, ok := relocated[file.Archive][file.RelativePath]
+			if ok {
+				file.Archive = newZip
+			}
+			return ok
+		})
+		if err != nil || changed == 0 {
+			refDB.Close()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		lg.Logs.Info("Moving %d files of the DB of run %s to the repacked zips", changed, snapshot.RunID)
+		err = db.ReplaceDBOfRun(task, snapshot.RunID, refDB)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the old zips are no longer referenced, delete them and drop them from
+	// the manifests of their runs
+	byRun := map[string]map[string]bool{}
+	for _, candidate := range candidates {
+		lg.Logs.Info("Deleting repacked zip %s", candidate.Zip.Key)
+		err := s3.DeleteFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), candidate.Zip.Key)
+		if err != nil {
+			lg.Logs.Warn("%s", err.Error())
+			continue
+		}
+		if byRun[candidate.RunID] == nil {
+			byRun[candidate.RunID] = map[string]bool{}
+		}
+		byRun[candidate.RunID][candidate.Zip.Key] = true
+		report.Repacked = append(report.Repacked, candidate)
+	}
+	for runID, deleted := range byRun {
+		// fetched again, the DB of the run may have been replaced above
+		manifest, err := db.FetchManifest(task, runID)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Archives = utils.Where(manifest.Archives, func(zip *db.ManifestObject) bool {
+			return !deleted[zip.Key]
+		})
+		err = db.CommitManifest(task, manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// liveEntries returns, for every zip, the entries referenced by any of the
+// snapshot DBs and their size.
+func liveEntries(task *utils.TaskConfig, snapshots []*db.DBGeneration) (map[string]map[string]int64, error) {
+	live := map[string]map[string]int64{}
+	for _, snapshot := range snapshots {
+		refDB, err := db.FetchDBOfRun(task, snapshot.RunID)
+		if err != nil {
+			return nil, err
+		}
+		err = refDB.ForEachSfile(func(file *types.SFile) error {
+			if file.Archive == "" {
+				return nil
+			}
+			if live[file.Archive] == nil {
+				live[file.Archive] = map[string]int64{}
+			}
+			// the holes of sparse files take no room in the zip
+			live[file.Archive][file.RelativePath] = file.StoredSize()
+			return nil
+		})
+		refDB.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+func selectCandidates(task *utils.TaskConfig, opts *Options, live map[string]map[string]int64, report *Report) ([]*Candidate, error) {
+	manifests, err := db.FetchCommittedManifests(task)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []*Candidate{}
+	now := time.Now()
+	for _, manifest := range manifests {
+		for _, zip := range manifest.Archives {
+			entries := live[zip.Key]
+			if len(entries) == 0 || zip.Bytes == 0 {
+				continue
+			}
+			candidate := &Candidate{Zip: zip, RunID: manifest.RunID, Live: entries}
+			for _, size := range entries {
+				candidate.LiveBytes += size
+			}
+			if candidate.Ratio() >= opts.Threshold {
+				continue
+			}
+
+			class := s3Types.StorageClass(zip.StorageClass)
+			until := s3.EarliestFreeDeletion(class, manifest.CreatedAt)
+			if now.Before(until) {
+				report.Deferred[zip.Key] = fmt.Sprintf("%s minimum storage duration ends %s", class, until.Format("2006-01-02"))
+				continue
+			}
+			if s3.NeedsRestore(class) {
+				state, err := s3.ObjectRestoreState(task.CreateS3Config(task.StorageClass), context.TODO(), zip.Key)
+				if err != nil {
+					return nil, err
+				}
+				switch state {
+				case s3.RestoreNotRequested:
+					if !opts.DryRun {
+						err := s3.RequestRestore(task.CreateS3Config(task.StorageClass), context.TODO(), zip.Key, opts.RestoreDays, opts.RestoreTier)
+						if err != nil {
+							return nil, err
+						}
+					}
+					report.Deferred[zip.Key] = fmt.Sprintf("%s restore requested", opts.RestoreTier)
+					continue
+				case s3.RestoreInProgress:
+					report.Deferred[zip.Key] = "restore in progress"
+					continue
+				}
+			}
+
+			lg.Logs.Info("Repacking %s: %d live entries, %.1f%% live", zip.Key, len(entries), candidate.Ratio()*100)
+			candidates = append(candidates, candidate)
+		}
+	}
+	for zip, reason := range report.Deferred {
+		lg.Logs.Info("Deferring repack of %s: %s", zip, reason)
+	}
+	return candidates, nil
+}
+
+// extractLive downloads the zip of the candidate and extracts its live
+// entries into dir.
+func extractLive(task *utils.TaskConfig, candidate *Candidate, dir string) error {
+	zipPath := dir + ".zip"
+	err := s3.DownloadFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), candidate.Zip.Key, zipPath, candidate.Zip.SHA256)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(zipPath)
+	return utils.UnzipSelected(zipPath, dir, task.Password, func(name string) bool {
+		_, ok := candidate.Live[name]
+		return ok
+	})
+}
+
+// rezip zips the extracted live entries of the candidates into new zips of
+// at most max_zip_size. It returns the new zips and, for every old zip, the
+// new zip of each of its entries. Entries of different zips may share a
+// name, so a new zip is started rather than holding a name twice.
+func rezip(task *utils.TaskConfig, candidates []*Candidate, workDir string) ([]*types.Archive, map[string]map[string]string, error) {
+	maxZipSizeInBytes := task.MaxZipSize * 1024 * 1024
+	archives := []*types.Archive{}
+	relocated := map[string]map[string]string{}
+
+	var zipper *archiver.Zipper
+	zipPath := ""
+	currentZippedFileSizeInBytes := int64(0)
+	names := map[string]bool{}
+	flush := func() {
+		if zipper == nil {
+			return
+		}
+		archive := zipper.Flush()
+		if archive != nil {
+			archives = append(archives, archive)
+		}
+		zipper = nil
+	}
+
+	for i, candidate := range candidates {
+		relocated[candidate.Zip.Key] = map[string]string{}
+		entries := []string{}
+		for name := range candidate.Live {
+			entries = append(entries, name)
+		}
+		sort.Strings(entries)
+
+		for _, name := range entries {
+			filePath := path.Join(workDir, fmt.Sprint(i), name)
+			fileStat, err := os.Stat(filePath)
+			if err != nil {
+				flush()
+				return nil, nil, fmt.Errorf("entry %s is missing from %s: %w", name, candidate.Zip.Key, err)
+			}
+			if zipper == nil || names[name] || (currentZippedFileSizeInBytes > 0 && currentZippedFileSizeInBytes+fileStat.Size() > maxZipSizeInBytes) {
+				flush()
+				zipPath = task.NewZipFileNameForTask(task.ID, len(archives), "_repack")
+				zipper = archiver.NewZipper(zipPath)
+				currentZippedFileSizeInBytes = 0
+				names = map[string]bool{}
+			}
+			// the entries are written as they were zipped, sparse files included
+			if _, _, err := zipper.Zip(filePath, name, &fileStat, task.Password, false); err != nil {
+				flush()
+				return nil, nil, err
+			}
+			names[name] = true
+			currentZippedFileSizeInBytes += fileStat.Size()
+			relocated[candidate.Zip.Key][name] = utils.FileNameFromPath(zipPath)
+		}
+	}
+	flush()
+	return archives, relocated, nil
+}
@@ -3,14 +3,46 @@ package restorer
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	lg "s3-diff-archive/logger"
 	"s3-diff-archive/utils"
 	"sort"
-	"strings"
 	"time"
 )
 
+type ChangeKind string
+
+const (
+	Added       ChangeKind = "added"
+	Modified    ChangeKind = "modified"
+	Deleted     ChangeKind = "deleted"
+	TypeChanged ChangeKind = "type-changed"
+	Moved       ChangeKind = "moved"
+)
+
+// Change is a difference between two trees, or between a tree and a DB.
+type Change struct {
+	Path      string     `json:"path"`
+	Kind      ChangeKind `json:"kind"`
+	From      string     `json:"from,omitempty"`       // previous path of a moved file
+	SizeDelta int64      `json:"size_delta,omitempty"` // in bytes, set by run diffs
+	Detail    string     `json:"detail,omitempty"`
+}
+
+var changeLetters = map[ChangeKind]string{Added: "A", Modified: "M", Deleted: "D", TypeChanged: "T", Moved: "R"}
+
+func (c *Change) String() string {
+	line := changeLetters[c.Kind] + " " + c.Path
+	if c.From != "" {
+		line = changeLetters[c.Kind] + " " + c.From + " -> " + c.Path
+	}
+	if c.Detail != "" {
+		line += " (" + c.Detail + ")"
+	}
+	return line
+}
+
 func DirsEqual(dir1, dir2 string, skips []string) (bool, error) {
 	// Canonicalize paths to ensure consistent comparison
 	absDir1, err := filepath.Abs(dir1)
@@ -38,115 +70,160 @@ func DirsEqual(dir1, dir2 string, skips []string) (bool, error) {
 		return false, nil
 	}
 
-	return compareDirsRecursive(absDir1, absDir2, skips)
-}
-
-// compareDirsRecursive is a helper function to recursively compare directories.
-func compareDirsRecursive(path1, path2 string, skips []string) (bool, error) {
-	entries1, err := os.ReadDir(path1)
+	changes, err := CompareDirs(absDir1, absDir2, func(relativePath string, info os.FileInfo) bool {
+		name := filepath.Base(relativePath)
+		if name == ".DS_Store" {
+			return true
+		}
+		for _, skipFile := range skips {
+			if utils.MatchPattern(skipFile, name) {
+				return true
+			}
+		}
+		return false
+	})
 	if err != nil {
 		lg.Logs.Error("%s", err.Error())
 		return false, err
 	}
-	entries2, err := os.ReadDir(path2)
-	if err != nil {
-		lg.Logs.Error("%s", err.Error())
-		return false, err
+	for _, change := range changes {
+		lg.Logs.Error("%s", change.String())
 	}
+	return len(changes) == 0, nil
+}
 
-	// Sort entries by name to ensure consistent comparison regardless of OS
-	sort.Slice(entries1, func(i, j int) bool {
-		return entries1[i].Name() < entries1[j].Name()
-	})
-	sort.Slice(entries2, func(i, j int) bool {
-		return entries2[i].Name() < entries2[j].Name()
-	})
+// CompareDirs lists every difference of dir1 against dir2: paths only in
+// dir1 are added, paths only in dir2 are deleted. Files are modified when
+// their size differs or their modification times are more than a second
+// apart, to allow for file systems with coarse timestamps, and symlinks when
+// their targets differ. Entries skip
+// returns true for are ignored, and so is everything below a skipped dir.
+func CompareDirs(dir1, dir2 string, skip func(relativePath string, info os.FileInfo) bool) ([]*Change, error) {
+	tree1, err := walkTree(dir1, false, skip)
+	if err != nil {
+		return nil, err
+	}
+	tree2, err := walkTree(dir2, false, skip)
+	if err != nil {
+		return nil, err
+	}
+	return compareTrees(dir1, dir2, tree1, tree2), nil
+}
 
-	// Check if the number of entries is the same
-	if len(entries1) != len(entries2) {
-		lg.Logs.Error("Number of entries are not equal. %s=%d, %s=%d", path1, len(entries1), path2, len(entries2))
-		names1 := make([]string, len(entries1))
-		for i, entry := range entries1 {
-			names1[i] = entry.Name()
+// compareTrees lists every difference of tree1, walked from dir1, against
+// tree2, walked from dir2, see CompareDirs.
+func compareTrees(dir1, dir2 string, tree1, tree2 map[string]os.FileInfo) []*Change {
+	changes := []*Change{}
+	for relativePath, info1 := range tree1 {
+		info2, ok := tree2[relativePath]
+		if !ok {
+			changes = append(changes, &Change{Path: relativePath, Kind: Added})
+			continue
 		}
-		names2 := make([]string, len(entries2))
-		for i, entry := range entries2 {
-			names2[i] = entry.Name()
+		if fileType(info1) != fileType(info2) {
+			changes = append(changes, &Change{Path: relativePath, Kind: TypeChanged, Detail: fileType(info2) + " -> " + fileType(info1)})
+			continue
 		}
-		lg.Logs.Error("Files in %s are:\n%s", path1, strings.Join(names1, "\n"))
-		lg.Logs.Error("Files in %s are:\n%s", path2, strings.Join(names2, "\n"))
-		return false, nil
-	}
-
-	for i := range entries1 {
-		entry1 := entries1[i]
-		entry2 := entries2[i]
-
-		if entry1.Name() == ".DS_Store" || entry2.Name() == ".DS_Store" {
+		if info1.IsDir() {
 			continue
 		}
-		skip := false
-		for _, skipFile := range skips {
-			if utils.MatchPattern(skipFile, entry1.Name()) {
-				skip = true
-				break
+		if info1.Mode()&os.ModeSymlink != 0 {
+			target1, _ := os.Readlink(filepath.Join(dir1, relativePath))
+			target2, _ := os.Readlink(filepath.Join(dir2, relativePath))
+			if target1 != target2 {
+				changes = append(changes, &Change{Path: relativePath, Kind: Modified, Detail: fmt.Sprintf("target %s -> %s", target2, target1)})
 			}
+			continue
 		}
-		if skip {
+		if info1.Size() != info2.Size() {
+			changes = append(changes, &Change{Path: relativePath, Kind: Modified, Detail: fmt.Sprintf("size %d -> %d", info2.Size(), info1.Size())})
 			continue
 		}
-
-		// Check if filenames are the same
-		if entry1.Name() != entry2.Name() {
-			return false, nil
+		threshold := 1 * time.Second
+		if time1, time2 := info1.ModTime().Truncate(time.Second), info2.ModTime().Truncate(time.Second); time1.After(time2.Add(threshold)) || time2.After(time1.Add(threshold)) {
+			changes = append(changes, &Change{Path: relativePath, Kind: Modified, Detail: fmt.Sprintf("mtime %s -> %s", info2.ModTime().Format(time.RFC3339), info1.ModTime().Format(time.RFC3339))})
 		}
+	}
+	for relativePath := range tree2 {
+		if _, ok := tree1[relativePath]; !ok {
+			changes = append(changes, &Change{Path: relativePath, Kind: Deleted})
+		}
+	}
+	sortChanges(changes)
+	return changes
+}
 
-		fullPath1 := filepath.Join(path1, entry1.Name())
-		fullPath2 := filepath.Join(path2, entry2.Name())
-
-		info1, err := entry1.Info()
-		if err != nil {
-			lg.Logs.Error("%s not found", info1.Name())
-			return false, err
+// walkTree returns every entry below root by its slash separated path
+// relative to root. Symlinks are returned as links unless followLinks is set;
+// then, like the scanner does with symlinks: follow, they are returned as
+// what they point to, dirs are walked into once each, and a dangling link is
+// returned as a link.
+func walkTree(root string, followLinks bool, skip func(relativePath string, info os.FileInfo) bool) (map[string]os.FileInfo, error) {
+	tree := map[string]os.FileInfo{}
+	visited := map[string]bool{} // real paths of the dirs walked, for followed symlinks
+	var walk func(dirPath, dirRelativePath string) error
+	walk = func(dirPath, dirRelativePath string) error {
+		if followLinks {
+			if realPath, err := filepath.EvalSymlinks(dirPath); err == nil {
+				if visited[realPath] {
+					return nil
+				}
+				visited[realPath] = true
+			}
 		}
-		info2, err := entry2.Info()
+		entries, err := os.ReadDir(dirPath)
 		if err != nil {
-			lg.Logs.Error("%s not found", info2.Name())
-			return false, err
+			return err
 		}
-
-		// Check if entry types (file/dir) are the same
-		if info1.IsDir() != info2.IsDir() {
-			fmt.Printf("Dirs are not equal: %s, %s\n", path1, path2)
-			return false, nil
-		}
-
-		if info1.IsDir() {
-			// Recursively compare subdirectories
-			equal, err := compareDirsRecursive(fullPath1, fullPath2, skips)
+		for _, entry := range entries {
+			filePath := filepath.Join(dirPath, entry.Name())
+			relativePath := path.Join(dirRelativePath, entry.Name())
+			info, err := entry.Info()
 			if err != nil {
-				return false, err
+				return err
 			}
-			if !equal {
-				return false, nil // Early exit
+			if followLinks && info.Mode()&os.ModeSymlink != 0 {
+				if target, err := os.Stat(filePath); err == nil {
+					info = target
+				}
 			}
-		} else {
-			// Compare files: size and modification time
-			if info1.Size() != info2.Size() {
-				lg.Logs.Error("File Sizes are not equal: %s, %s\n", info1.Name(), info2.Name())
-				return false, nil
+			if skip != nil && skip(relativePath, info) {
+				continue
 			}
-
-			// Compare modification times. Truncate to second precision to
-			// allow a threshold of 2 seconds for timestamp differences
-			threshold := 1 * time.Second
-			// account for file system differences in timestamp granularity.
-			if time1, time2 := info1.ModTime().Truncate(time.Second), info2.ModTime().Truncate(time.Second); time1.After(time2.Add(threshold)) || time2.After(time1.Add(threshold)) {
-				lg.Logs.Error("Mod times are not within threshold: %s : %s, %s : %s\n", info1.Name(), info1.ModTime(), info2.Name(), info2.ModTime())
-				return false, nil
+			tree[relativePath] = info
+			if info.IsDir() {
+				if err := walk(filePath, relativePath); err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	}
+	return tree, walk(root, "")
+}
+
+func fileType(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "other"
 	}
+}
 
-	return true, nil
+func sortChanges(changes []*Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
 }
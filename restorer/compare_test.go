@@ -0,0 +1,84 @@
+package restorer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"s3-diff-archive/utils"
+	"sort"
+	"testing"
+)
+
+func treePaths(tree map[string]os.FileInfo) []string {
+	paths := []string{}
+	for relativePath := range tree {
+		paths = append(paths, relativePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestWalkTreeSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	for _, name := range []string{"a/f.txt", "a/b/g.txt"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "h.txt"), []byte("h"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"ext":      outside,                              // a dir outside the tree
+		"loop":     dir,                                  // the root itself
+		"z-again":  filepath.Join(dir, "a"),              // a dir walked already
+		"dangling": filepath.Join(dir, "does-not-exist"), // a link to nothing
+		"file.lnk": filepath.Join(dir, "a", "f.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Skipf("symlinks are not supported: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		symlinks string
+		paths    []string
+	}{
+		{
+			name:     "store keeps links as links",
+			symlinks: utils.SymlinksStore,
+			paths:    []string{"a", "a/b", "a/b/g.txt", "a/f.txt", "dangling", "ext", "file.lnk", "loop", "z-again"},
+		},
+		{
+			name:     "follow walks into linked dirs once and skips dangling links",
+			symlinks: utils.SymlinksFollow,
+			paths:    []string{"a", "a/b", "a/b/g.txt", "a/f.txt", "ext", "ext/h.txt", "file.lnk", "loop", "z-again"},
+		},
+		{
+			name:     "skip leaves links out",
+			symlinks: utils.SymlinksSkip,
+			paths:    []string{"a", "a/b", "a/b/g.txt", "a/f.txt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &utils.TaskConfig{Task: utils.Task{Symlinks: test.symlinks}}
+			tree, err := walkTree(dir, test.symlinks == utils.SymlinksFollow, excludeSkip(task, utils.Root{Path: dir}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paths := treePaths(tree); !reflect.DeepEqual(paths, test.paths) {
+				t.Errorf("walked %v, want %v", paths, test.paths)
+			}
+			if test.symlinks == utils.SymlinksFollow && !tree["ext"].IsDir() {
+				t.Errorf("followed link ext is not a dir")
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package restorer
+
+import (
+	"fmt"
+	"s3-diff-archive/db"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"sort"
+	"strings"
+)
+
+// DirSummary aggregates the changes below a top-level dir of the task.
+type DirSummary struct {
+	Dir       string `json:"dir"`
+	Added     int    `json:"added"`
+	Modified  int    `json:"modified"`
+	Deleted   int    `json:"deleted"`
+	Moved     int    `json:"moved"`
+	SizeDelta int64  `json:"size_delta"` // change of the stored size
+	Archived  int64  `json:"archived"`   // bytes the later run had to archive
+}
+
+type RunDiff struct {
+	TaskID    string        `json:"task_id"`
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	Changes   []*Change     `json:"changes"`
+	Dirs      []*DirSummary `json:"dirs"`
+	SizeDelta int64         `json:"size_delta"`
+	Archived  int64         `json:"archived"`
+}
+
+func (d *RunDiff) Message() string {
+	return fmt.Sprintf("Task: %s, %s -> %s, Changes: %d, Size delta: %+d bytes, Archived: %d bytes",
+		d.TaskID, d.From, d.To, len(d.Changes), d.SizeDelta, d.Archived)
+}
+
+// DiffRuns compares the DBs of two runs of the task. Files whose content
+// moved to another path are reported as moved, matched by their SHA-256 or,
+// for files archived before hashes were recorded, by name, size and mtime.
+func DiffRuns(task *utils.TaskConfig, fromRun, toRun string) (*RunDiff, error) {
+	from, err := runFiles(task, fromRun)
+	if err != nil {
+		return nil, err
+	}
+	to, err := runFiles(task, toRun)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &RunDiff{TaskID: task.ID, From: fromRun, To: toRun, Changes: []*Change{}}
+	deleted := map[string]*types.SFile{}
+	added := map[string]*types.SFile{}
+	for relativePath, file := range from {
+		if _, ok := to[relativePath]; !ok {
+			deleted[relativePath] = file
+		}
+	}
+	for relativePath, newFile := range to {
+		oldFile, ok := from[relativePath]
+		if !ok {
+			added[relativePath] = newFile
+			continue
+		}
+		// a run before metadata was recorded has none to compare
+		metaChanged := oldFile.Meta != nil && !newFile.Meta.Equal(oldFile.Meta)
+		if newFile.Size == oldFile.Size && newFile.Mtime == oldFile.Mtime && newFile.Hash == oldFile.Hash && newFile.Archive == oldFile.Archive && newFile.Type == oldFile.Type && newFile.Target == oldFile.Target && !metaChanged {
+			continue
+		}
+		change := &Change{Path: relativePath, Kind: Modified, SizeDelta: newFile.StoredSize() - oldFile.StoredSize()}
+		if newFile.Size != oldFile.Size {
+			change.Detail = fmt.Sprintf("size %d -> %d", oldFile.Size, newFile.Size)
+		} else if metaChanged && newFile.Hash == oldFile.Hash && newFile.Mtime == oldFile.Mtime {
+			change.Detail = "metadata"
+		}
+		diff.Changes = append(diff.Changes, change)
+	}
+
+	// moves are deletes and adds of the same content. Entries without
+	// content, like empty files, links and dirs, all look alike and are
+	// never matched
+	byContent := map[string][]string{}
+	for relativePath, file := range deleted {
+		if !hasMovableContent(file) {
+			continue
+		}
+		byContent[contentKey(file)] = append(byContent[contentKey(file)], relativePath)
+	}
+	addedPaths := []string{}
+	for relativePath := range added {
+		addedPaths = append(addedPaths, relativePath)
+	}
+	sort.Strings(addedPaths)
+	for _, relativePath := range addedPaths {
+		file := added[relativePath]
+		candidates := byContent[contentKey(file)]
+		if !hasMovableContent(file) || len(candidates) != 1 {
+			diff.Changes = append(diff.Changes, &Change{Path: relativePath, Kind: Added, SizeDelta: file.StoredSize()})
+			continue
+		}
+		delete(byContent, contentKey(file))
+		delete(deleted, candidates[0])
+		diff.Changes = append(diff.Changes, &Change{Path: relativePath, From: candidates[0], Kind: Moved})
+	}
+	for relativePath, file := range deleted {
+		diff.Changes = append(diff.Changes, &Change{Path: relativePath, Kind: Deleted, SizeDelta: -file.StoredSize()})
+	}
+	sortChanges(diff.Changes)
+
+	dirs := map[string]*DirSummary{}
+	for _, change := range diff.Changes {
+		dir := topLevelDir(change.Path)
+		if dirs[dir] == nil {
+			dirs[dir] = &DirSummary{Dir: dir}
+		}
+		summary := dirs[dir]
+		switch change.Kind {
+		case Added:
+			summary.Added++
+		case Modified:
+			summary.Modified++
+		case Deleted:
+			summary.Deleted++
+		case Moved:
+			summary.Moved++
+		}
+		summary.SizeDelta += change.SizeDelta
+		diff.SizeDelta += change.SizeDelta
+		// a moved file is archived again under its new path
+		if newFile, ok := to[change.Path]; ok {
+			if oldFile := from[change.Path]; oldFile == nil || newFile.Archive != oldFile.Archive {
+				summary.Archived += newFile.StoredSize()
+				diff.Archived += newFile.StoredSize()
+			}
+		}
+	}
+	for _, summary := range dirs {
+		diff.Dirs = append(diff.Dirs, summary)
+	}
+	sort.Slice(diff.Dirs, func(i, j int) bool {
+		return diff.Dirs[i].Archived > diff.Dirs[j].Archived
+	})
+	return diff, nil
+}
+
+func runFiles(task *utils.TaskConfig, runID string) (map[string]*types.SFile, error) {
+	refDB, err := db.FetchDBOfRun(task, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer refDB.Close()
+	files := map[string]*types.SFile{}
+	err = refDB.ForEachSfile(func(file *types.SFile) error {
+		files[file.RelativePath] = file
+		return nil
+	})
+	return files, err
+}
+
+func hasMovableContent(file *types.SFile) bool {
+	return file.HasContent() && file.Size > 0
+}
+
+func contentKey(file *types.SFile) string {
+	if file.Hash != "" {
+		return file.Hash
+	}
+	return fmt.Sprintf("%s/%d/%d", file.Name, file.Size, file.Mtime)
+}
+
+func topLevelDir(relativePath string) string {
+	dir, _, found := strings.Cut(relativePath, "/")
+	if !found {
+		return "."
+	}
+	return dir
+}
@@ -2,12 +2,19 @@ package restorer
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
 	"path"
+	"path/filepath"
 	"s3-diff-archive/db"
 	lg "s3-diff-archive/logger"
 	"s3-diff-archive/s3"
+	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
+	"sort"
 	"strings"
+	"time"
 )
 
 func RestoreFromZips(zipPaths []string, outputPath string, password string) error {
@@ -20,35 +27,583 @@ func RestoreFromZips(zipPaths []string, outputPath string, password string) erro
 	return nil
 }
 
-func ExperimentalDownloadArchivedZips(task *utils.TaskConfig) ([]string, error) {
+const (
+	ConflictSkip      = "skip"      // keep the existing file
+	ConflictOverwrite = "overwrite" // replace the existing file
+	ConflictNewer     = "newer"     // replace the existing file if the backup is newer
+	ConflictRename    = "rename"    // restore next to the existing file under a new name
+)
+
+const (
+	ActionCreate    = "create"
+	ActionOverwrite = "overwrite"
+	ActionRename    = "rename"
+	ActionSkip      = "skip"
+	ActionUnchanged = "unchanged"
+	ActionMetadata  = "metadata" // content matches, only the metadata is applied
+	ActionDelete    = "delete"
+)
+
+type RestoreOptions struct {
+	Target     string // dir the files are restored into
+	OnConflict string // what to do with files that already exist in the target
+	DryRun     bool   // only list the actions
+	Mirror     bool   // delete files of the target that are not in the backup
+	Prefix     string // only restore the files archived under this prefix, without it
+}
+
+// RestoreAction is what a restore does, or would do, with one path of the
+// target. Path is relative to the target.
+type RestoreAction struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Dest   string `json:"dest,omitempty"` // name the backup is restored under, for renames
+	Detail string `json:"detail,omitempty"`
+}
+
+func (a *RestoreAction) String() string {
+	line := fmt.Sprintf("%-9s %s", a.Action, a.Path)
+	if a.Dest != "" {
+		line += " -> " + a.Dest
+	}
+	if a.Detail != "" {
+		line += " (" + a.Detail + ")"
+	}
+	return line
+}
+
+type RestoreReport struct {
+	TaskID     string           `json:"task_id"`
+	Target     string           `json:"target"`
+	DryRun     bool             `json:"dry_run"`
+	Skipped    int              `json:"skipped"`     // files whose zip is not part of a committed run
+	MetaFailed int              `json:"meta_failed"` // files whose metadata could not be fully applied
+	Actions    []*RestoreAction `json:"actions"`
+}
+
+func (r *RestoreReport) Message() string {
+	prefix := ""
+	if r.DryRun {
+		prefix = "[dry run] "
+	}
+	counts := map[string]int{}
+	for _, action := range r.Actions {
+		counts[action.Action]++
+	}
+	return fmt.Sprintf("%sTask: %s, Target: %s, Created: %d, Overwritten: %d, Renamed: %d, Metadata: %d, Skipped: %d, Unchanged: %d, Deleted: %d",
+		prefix, r.TaskID, r.Target, counts[ActionCreate], counts[ActionOverwrite], counts[ActionRename], counts[ActionMetadata], counts[ActionSkip]+r.Skipped, counts[ActionUnchanged], counts[ActionDelete])
+}
+
+// RestoreTask restores the files of the current DB of the task into the
+// target. Files that already exist in the target are handled by the conflict
+// policy, and files identical to the backup, by size and modification time,
+// are left alone. Files of the target that are not in the backup are only
+// deleted with Mirror; files the path rules of the task skip never are.
+//
+// Only zips referenced by a committed manifest are read, along with the zips
+// of the reg file for files archived before manifests existed, and only zips
+// holding a file that is written are downloaded.
+func RestoreTask(task *utils.TaskConfig, opts *RestoreOptions) (*RestoreReport, error) {
+	refDB := db.FetchRemoteDB(task)
+	defer refDB.Close()
+
+	committed, err := committedArchives(task)
+	if err != nil {
+		return nil, err
+	}
 	fileReg, err := db.FetchRegOfTask(task)
-	zipPaths := []string{}
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	legacyZips := db.ParseReg(fileReg)
+	for _, zip := range legacyZips {
+		committed[zip.Name] = zip.SHA256
 	}
 
-	if fileReg == "" {
-		lg.Logs.Warn("No reg file found for task %s", task.ID)
-		return zipPaths, nil
+	plan, err := planRestore(task, opts, refDB, committed)
+	if err != nil {
+		return nil, err
+	}
+	report := plan.report
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, destPath := range plan.replaced {
+		if err := os.Remove(destPath); err != nil {
+			return nil, err
+		}
 	}
 
-	fileList := strings.Split(fileReg, "\n")
-	lg.Logs.Info("Downlaoding Archived Zips for task %s, files: %d...", task.ID, len(fileList))
-	for _, file := range fileList {
-		if strings.TrimSpace(file) == "" {
+	archives := []string{}
+	for archive := range plan.byArchive {
+		archives = append(archives, archive)
+	}
+	sort.Strings(archives)
+
+	lg.Logs.Info("Restoring task %s into %s from %d zips", task.ID, plan.target, len(archives))
+	for _, archive := range archives {
+		files := plan.byArchive[archive]
+		err := restoreFromArchive(task, archive, committed[archive], func(name string) *utils.ExtractTo { return files[name] })
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(plan.legacyFiles) > 0 {
+		// older zips don't say which file is where, so every registered zip is
+		// extracted in upload order and newer versions overwrite older ones
+		lg.Logs.Info("Restoring %d files of task %s from %d registered zips", len(plan.legacyFiles), task.ID, len(legacyZips))
+		for _, zip := range legacyZips {
+			err := restoreFromArchive(task, zip.Name, zip.SHA256, func(name string) *utils.ExtractTo { return plan.legacyFiles[name] })
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := joinVolumes(plan.joins, plan.written); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range plan.links {
+		if entry.action.Action == ActionSkip {
 			continue
 		}
-		downloadPath := path.Join(task.WorkingDir, task.ID, file)
+		if err := createEntry(entry.file, entry.destPath, plan.placed[entry.file.Target]); err != nil {
+			return nil, err
+		}
+	}
+
+	applyMeta(plan.withMeta, report)
+
+	// last, writing into a dir changes its modification time
+	for _, entry := range plan.links {
+		if entry.file.Type == types.FileTypeDir && entry.action.Action != ActionSkip {
+			mtime := time.Unix(entry.file.Mtime, 0)
+			if err := os.Chtimes(entry.destPath, mtime, mtime); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, action := range report.Actions {
+		if action.Action != ActionDelete {
+			continue
+		}
+		lg.Logs.Info("Deleting %s, it is not in the backup", action.Path)
+		if err := os.Remove(filepath.Join(plan.target, filepath.FromSlash(action.Path))); err != nil {
+			return nil, err
+		}
+	}
+
+	if report.Skipped > 0 {
+		lg.Logs.Warn("%d files of task %s were skipped", report.Skipped, task.ID)
+	}
+	return report, nil
+}
+
+// restorePlan is what a restore does, decided before anything is written.
+type restorePlan struct {
+	report      *RestoreReport
+	target      string
+	byArchive   map[string]map[string]*utils.ExtractTo // destination of every file that is written, grouped by the zip holding its content
+	legacyFiles map[string]*utils.ExtractTo            // files of zips archived before manifests existed, by entry name
+	withMeta    map[string]*types.FileMeta             // every file written or whose metadata is applied
+	placed      map[string]string                      // path of every file that will hold the content of the backup, to where
+	links       []*plannedEntry                        // links, dirs and special files, created once the content is in place
+	replaced    []string                               // removed before writing, not to write through a symlink
+	written     map[string]*plannedEntry               // files whose content is extracted
+	joins       []*plannedEntry                        // volumes of command outputs, appended to their first part
+}
+
+// planRestore decides what a restore of the files of refDB into the target
+// does with every path, from what is in the target.
+func planRestore(task *utils.TaskConfig, opts *RestoreOptions, refDB *db.DBContainer, committed map[string]string) (*restorePlan, error) {
+	report := &RestoreReport{TaskID: task.ID, Target: opts.Target, DryRun: opts.DryRun, Actions: []*RestoreAction{}}
+	target := filepath.Clean(opts.Target)
+	var err error
+
+	// a command output split into volumes is restored as one file, its size
+	// is the sum of the sizes of its volumes
+	outputSizes := map[string]int64{}
+	if task.Source == utils.SourceCommand {
+		err = refDB.ForEachSfile(func(file *types.SFile) error {
+			if file.Volume > 0 {
+				outputSizes[file.Target] += file.Size
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		err = s3.DownloadFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), file, downloadPath)
+	// the target is walked whole, a file the filters skip is still there
+	// to conflict with
+	existing := map[string]os.FileInfo{}
+	if _, err := os.Stat(target); err == nil {
+		existing, err = walkTree(target, false, nil)
 		if err != nil {
-			return []string{}, err
+			return nil, err
+		}
+	}
+
+	// destination of every file that is written, grouped by the zip holding
+	// its content
+	byArchive := map[string]map[string]*utils.ExtractTo{}
+	legacyFiles := map[string]*utils.ExtractTo{}
+	inBackup := map[string]bool{}
+	withMeta := map[string]*types.FileMeta{} // every file written or whose metadata is applied
+	placed := map[string]string{}            // path of every file that will hold the content of the backup, to where
+	links := []*plannedEntry{}               // links, dirs and special files, created once the content is in place
+	replaced := []string{}                   // removed before writing, not to write through a symlink
+	written := map[string]*plannedEntry{}    // files whose content is extracted
+	volumes := []*types.SFile{}              // parts of command outputs, appended to their first part
+	renameSuffix := ".restored-" + utils.NewRunID()
+	err = refDB.ForEachSfile(func(file *types.SFile) error {
+		entryName := file.RelativePath // of its zip entry
+		if opts.Prefix != "" {
+			relativePath, ok := strings.CutPrefix(file.RelativePath, opts.Prefix+"/")
+			if !ok {
+				return nil
+			}
+			file.RelativePath = relativePath
+			if file.Type == types.FileTypeHardlink {
+				// the scanner only links files of the same dir
+				file.Target = strings.TrimPrefix(file.Target, opts.Prefix+"/")
+			}
+		}
+		inBackup[file.RelativePath] = true
+		if file.Archive != "" {
+			if _, ok := committed[file.Archive]; !ok {
+				lg.Logs.Warn("Skipping %s, its zip %s is not part of a committed run", file.RelativePath, file.Archive)
+				report.Skipped++
+				return nil
+			}
+		}
+		if file.Volume > 0 {
+			volumes = append(volumes, file)
+			return nil
+		}
+		destPath := filepath.Join(target, filepath.FromSlash(file.RelativePath))
+		if !strings.HasPrefix(destPath, target+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path in DB: %s", file.RelativePath)
+		}
+
+		info := existing[file.RelativePath]
+		planned := file
+		if size, ok := outputSizes[entryName]; ok {
+			joined := *file
+			joined.Size += size
+			planned = &joined
+		}
+		action := planFile(planned, info, destPath, opts.OnConflict)
+		if action.Action == ActionUnchanged && file.Meta != nil {
+			meta, err := utils.ReadFileMeta(destPath, info)
+			if err == nil && !meta.Equal(file.Meta) {
+				action.Action = ActionMetadata
+			}
+		}
+		report.Actions = append(report.Actions, action)
+		switch action.Action {
+		case ActionSkip:
+			return nil
+		case ActionUnchanged, ActionMetadata:
+			placed[file.RelativePath] = destPath
+			if action.Action == ActionMetadata {
+				withMeta[destPath] = file.Meta
+			}
+			return nil
+		case ActionRename:
+			action.Dest = file.RelativePath + renameSuffix
+			destPath += renameSuffix
+		case ActionOverwrite:
+			if !file.HasContent() || info.Mode()&os.ModeSymlink != 0 {
+				replaced = append(replaced, destPath)
+			}
 		}
+		placed[file.RelativePath] = destPath
+		if file.Meta != nil {
+			withMeta[destPath] = file.Meta
+		}
+
+		switch {
+		case !file.HasContent():
+			links = append(links, &plannedEntry{file: file, action: action, destPath: destPath})
+		case file.Archive == "":
+			written[file.RelativePath] = &plannedEntry{file: file, action: action, destPath: destPath}
+			legacyFiles[entryName] = &utils.ExtractTo{Path: destPath}
+		default:
+			written[file.RelativePath] = &plannedEntry{file: file, action: action, destPath: destPath}
+			if byArchive[file.Archive] == nil {
+				byArchive[file.Archive] = map[string]*utils.ExtractTo{}
+			}
+			byArchive[file.Archive][entryName] = &utils.ExtractTo{Path: destPath, Holes: file.Holes, Size: file.Size}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a volume is extracted next to its first part, only when that is
+	// written, and appended to it
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].Target != volumes[j].Target {
+			return volumes[i].Target < volumes[j].Target
+		}
+		return volumes[i].Volume < volumes[j].Volume
+	})
+	joins := []*plannedEntry{}
+	for _, file := range volumes {
+		first, ok := written[file.Target]
+		if !ok {
+			continue
+		}
+		partPath := fmt.Sprintf("%s.volume-%d", first.destPath, file.Volume)
+		if byArchive[file.Archive] == nil {
+			byArchive[file.Archive] = map[string]*utils.ExtractTo{}
+		}
+		byArchive[file.Archive][file.RelativePath] = &utils.ExtractTo{Path: partPath}
+		joins = append(joins, &plannedEntry{file: file, action: first.action, destPath: partPath})
+	}
 
-		lg.Logs.Info("Downloaded file: %s", file)
-		zipPaths = append(zipPaths, downloadPath)
+	// a hardlink needs the file it shares its content with
+	for _, entry := range links {
+		if entry.file.Type != types.FileTypeHardlink {
+			continue
+		}
+		if _, ok := placed[entry.file.Target]; !ok {
+			entry.action.Action = ActionSkip
+			entry.action.Detail = "linked file " + entry.file.Target + " is not restored"
+			delete(withMeta, entry.destPath)
+		}
+	}
+
+	// decided before anything is written, so renamed copies are kept
+	if opts.Mirror {
+		// only by their paths, the size and age of the files of the target
+		// say nothing of whether they belong to the backup
+		filter := utils.NewFilter(task, utils.Root{Path: target, Prefix: opts.Prefix})
+		for relativePath, info := range existing {
+			if rule, _ := filter.SkipEntry(relativePath); rule != "" {
+				continue
+			}
+			if (info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0) && !inBackup[relativePath] {
+				report.Actions = append(report.Actions, &RestoreAction{Path: relativePath, Action: ActionDelete})
+			}
+		}
+	}
+	sort.Slice(report.Actions, func(i, j int) bool {
+		return report.Actions[i].Path < report.Actions[j].Path
+	})
+	return &restorePlan{
+		report:      report,
+		target:      target,
+		byArchive:   byArchive,
+		legacyFiles: legacyFiles,
+		withMeta:    withMeta,
+		placed:      placed,
+		links:       links,
+		replaced:    replaced,
+		written:     written,
+		joins:       joins,
+	}, nil
+}
+
+// joinVolumes appends the extracted volumes of command outputs, sorted by
+// output and number, to their first part and removes them. An output missing
+// a volume is left with the volumes before it.
+func joinVolumes(joins []*plannedEntry, written map[string]*plannedEntry) error {
+	next := map[string]int{}
+	for _, part := range joins {
+		first := written[part.file.Target]
+		if next[part.file.Target] == 0 {
+			next[part.file.Target] = 2
+		}
+		if part.file.Volume != next[part.file.Target] {
+			if next[part.file.Target] > 0 {
+				lg.Logs.Warn("%s is incomplete, volume %d of it is not restored", first.destPath, next[part.file.Target])
+			}
+			next[part.file.Target] = -1
+			os.Remove(part.destPath)
+			continue
+		}
+		next[part.file.Target]++
+		if err := appendFile(first.destPath, part.destPath); err != nil {
+			return err
+		}
+		mtime := time.Unix(first.file.Mtime, 0)
+		if err := os.Chtimes(first.destPath, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendFile appends the content of partPath to destPath and removes it.
+func appendFile(destPath, partPath string) error {
+	part, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath)
+	defer part.Close()
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, part); err != nil {
+		dest.Close()
+		return fmt.Errorf("failed to append %s to %s: %w", partPath, destPath, err)
+	}
+	return dest.Close()
+}
+
+// applyMeta applies the recorded metadata of the restored files. Running as
+// root, every failure is logged; otherwise some are expected, like xattrs of
+// the trusted namespace, and only their count is.
+func applyMeta(withMeta map[string]*types.FileMeta, report *RestoreReport) {
+	root := os.Geteuid() == 0
+	for destPath, meta := range withMeta {
+		err := utils.ApplyFileMeta(destPath, meta)
+		if err == nil {
+			continue
+		}
+		report.MetaFailed++
+		if root {
+			lg.Logs.Warn("%s", err.Error())
+		}
+	}
+	if report.MetaFailed > 0 && !root {
+		lg.Logs.Warn("The metadata of %d files of task %s could not be fully applied, restore as root to keep owners", report.MetaFailed, report.TaskID)
+	}
+}
+
+// plannedEntry is a link, empty dir or special file of the backup that is
+// created in the target.
+type plannedEntry struct {
+	file     *types.SFile
+	action   *RestoreAction
+	destPath string
+}
+
+// createEntry creates a dir, symlink, hardlink or special file of the backup
+// at destPath.
+// linkedPath is where the file a hardlink shares its content with was put.
+func createEntry(file *types.SFile, destPath, linkedPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", destPath, err)
+	}
+	switch file.Type {
+	case types.FileTypeDir:
+		if err := os.MkdirAll(destPath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", destPath, err)
+		}
+	case types.FileTypeSymlink:
+		if err := os.Symlink(file.Target, destPath); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", destPath, err)
+		}
+	case types.FileTypeHardlink:
+		if err := os.Link(linkedPath, destPath); err != nil {
+			return fmt.Errorf("failed to link %s to %s: %w", destPath, linkedPath, err)
+		}
+	default:
+		return utils.MakeSpecialFile(destPath, file.Type, file.Device)
+	}
+	return nil
+}
+
+// sameAsBackup reports whether what is at the path of a backup entry in the
+// target already matches it: a file of the same size and modification
+// time, a symlink to the same target, a dir, or a special file of the same
+// type and device.
+func sameAsBackup(file *types.SFile, info os.FileInfo, destPath string) bool {
+	switch file.Type {
+	case types.FileTypeDir:
+		return info.IsDir()
+	case types.FileTypeSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+		target, err := os.Readlink(destPath)
+		return err == nil && target == file.Target
+	case types.FileTypeRegular, types.FileTypeHardlink:
+		return info.Mode().IsRegular() && info.Size() == file.Size && info.ModTime().Unix() == file.Mtime
+	default:
+		return utils.SpecialFileType(info) == file.Type && utils.DeviceNumber(info) == file.Device
+	}
+}
+
+// planFile decides what to do with an entry of the backup given what is at
+// its path in the target, if anything.
+func planFile(file *types.SFile, info os.FileInfo, destPath, onConflict string) *RestoreAction {
+	action := &RestoreAction{Path: file.RelativePath}
+	replaceable := info != nil && (info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0)
+	switch {
+	case info != nil && sameAsBackup(file, info, destPath):
+		action.Action = ActionUnchanged
+	case file.Type == types.FileTypeSocket:
+		action.Action = ActionSkip
+		action.Detail = "sockets cannot be restored"
+	case (file.Type == types.FileTypeDevice || file.Type == types.FileTypeChar) && os.Geteuid() != 0:
+		action.Action = ActionSkip
+		action.Detail = "devices can only be created by root"
+	case info == nil:
+		action.Action = ActionCreate
+	case file.Type == types.FileTypeDir:
+		action.Action = ActionSkip
+		action.Detail = "target is a " + fileType(info)
+	case onConflict == ConflictRename:
+		action.Action = ActionRename
+	case !replaceable:
+		// never replace a directory or special file
+		action.Action = ActionSkip
+		action.Detail = "target is a " + fileType(info)
+	case onConflict == ConflictOverwrite:
+		action.Action = ActionOverwrite
+	case onConflict == ConflictNewer && file.Mtime > info.ModTime().Unix():
+		action.Action = ActionOverwrite
+		action.Detail = "backup is newer"
+	case onConflict == ConflictNewer:
+		action.Action = ActionSkip
+		action.Detail = "target is newer"
+	default:
+		action.Action = ActionSkip
+		action.Detail = "exists"
+	}
+	return action
+}
+
+// committedArchives returns the checksum of every zip referenced by a
+// committed manifest of the task, keyed by name.
+func committedArchives(task *utils.TaskConfig) (map[string]string, error) {
+	manifests, err := db.FetchCommittedManifests(task)
+	if err != nil {
+		return nil, err
+	}
+	committed := map[string]string{}
+	for _, manifest := range manifests {
+		for _, archive := range manifest.Archives {
+			committed[archive.Key] = archive.SHA256
+		}
+	}
+	return committed, nil
+}
+
+// restoreFromArchive downloads a zip and extracts the entries dest returns a
+// target for.
+func restoreFromArchive(task *utils.TaskConfig, archive, checksum string, dest func(name string) *utils.ExtractTo) error {
+	downloadPath := path.Join(task.WorkingDir, task.ID, archive)
+	err := s3.DownloadFileFromS3(task.CreateS3Config(task.StorageClass), context.TODO(), archive, downloadPath, checksum)
+	if err != nil {
+		return err
 	}
-	lg.Logs.Info("Task %s downloaded in %s", task.ID, strings.Join(zipPaths, ", "))
+	defer os.Remove(downloadPath)
 
-	return zipPaths, nil
+	lg.Logs.Info("Extracting %s", archive)
+	return utils.UnzipTo(downloadPath, task.Password, func(name string) (*utils.ExtractTo, error) {
+		return dest(name), nil
+	})
 }
@@ -0,0 +1,150 @@
+package restorer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"s3-diff-archive/db"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"testing"
+	"time"
+)
+
+func TestPlanFile(t *testing.T) {
+	target := t.TempDir()
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(filepath.Join(target, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(target, "file"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(target, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(target, "link")); err != nil {
+		t.Skipf("symlinks are not supported: %s", err)
+	}
+	hasFIFO := utils.MakeSpecialFile(filepath.Join(target, "fifo"), types.FileTypeFIFO, 0) == nil
+	existing, err := walkTree(target, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older, newer := mtime.Unix()-100, mtime.Unix()+100
+	regular := func(size, mtime int64) *types.SFile {
+		return &types.SFile{Size: size, Mtime: mtime}
+	}
+	symlink := func(target string) *types.SFile {
+		return &types.SFile{Type: types.FileTypeSymlink, Target: target, Mtime: older}
+	}
+	special := func(fileType string) *types.SFile {
+		return &types.SFile{Type: fileType, Mtime: newer}
+	}
+
+	// actions for the conflict policies skip, overwrite, newer and rename
+	tests := []struct {
+		name    string
+		path    string
+		file    *types.SFile
+		actions [4]string
+	}{
+		{"file not in the target", "new", regular(4, newer), [4]string{ActionCreate, ActionCreate, ActionCreate, ActionCreate}},
+		{"same file", "file", regular(4, mtime.Unix()), [4]string{ActionUnchanged, ActionUnchanged, ActionUnchanged, ActionUnchanged}},
+		{"older file", "file", regular(5, older), [4]string{ActionSkip, ActionOverwrite, ActionSkip, ActionRename}},
+		{"newer file", "file", regular(5, newer), [4]string{ActionSkip, ActionOverwrite, ActionOverwrite, ActionRename}},
+		{"file over a dir", "dir", regular(5, newer), [4]string{ActionSkip, ActionSkip, ActionSkip, ActionRename}},
+		{"file over a symlink", "link", regular(4, older), [4]string{ActionSkip, ActionOverwrite, ActionSkip, ActionRename}},
+		{"file over a fifo", "fifo", regular(4, newer), [4]string{ActionSkip, ActionSkip, ActionSkip, ActionRename}},
+		{"dir not in the target", "new", special(types.FileTypeDir), [4]string{ActionCreate, ActionCreate, ActionCreate, ActionCreate}},
+		{"same dir", "dir", special(types.FileTypeDir), [4]string{ActionUnchanged, ActionUnchanged, ActionUnchanged, ActionUnchanged}},
+		{"dir over a file", "file", special(types.FileTypeDir), [4]string{ActionSkip, ActionSkip, ActionSkip, ActionSkip}},
+		{"symlink not in the target", "new", symlink("file"), [4]string{ActionCreate, ActionCreate, ActionCreate, ActionCreate}},
+		{"same symlink", "link", symlink("file"), [4]string{ActionUnchanged, ActionUnchanged, ActionUnchanged, ActionUnchanged}},
+		{"symlink to another target", "link", symlink("other"), [4]string{ActionSkip, ActionOverwrite, ActionSkip, ActionRename}},
+		{"symlink over a file", "file", symlink("file"), [4]string{ActionSkip, ActionOverwrite, ActionSkip, ActionRename}},
+		{"symlink over a dir", "dir", symlink("file"), [4]string{ActionSkip, ActionSkip, ActionSkip, ActionRename}},
+		{"fifo not in the target", "new", special(types.FileTypeFIFO), [4]string{ActionCreate, ActionCreate, ActionCreate, ActionCreate}},
+		{"same fifo", "fifo", special(types.FileTypeFIFO), [4]string{ActionUnchanged, ActionUnchanged, ActionUnchanged, ActionUnchanged}},
+		{"fifo over a file", "file", special(types.FileTypeFIFO), [4]string{ActionSkip, ActionOverwrite, ActionOverwrite, ActionRename}},
+		{"fifo over a dir", "dir", special(types.FileTypeFIFO), [4]string{ActionSkip, ActionSkip, ActionSkip, ActionRename}},
+		{"socket", "new", special(types.FileTypeSocket), [4]string{ActionSkip, ActionSkip, ActionSkip, ActionSkip}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.path == "fifo" && !hasFIFO {
+				t.Skip("fifos are not supported")
+			}
+			test.file.RelativePath = test.path
+			destPath := filepath.Join(target, test.path)
+			for i, onConflict := range []string{ConflictSkip, ConflictOverwrite, ConflictNewer, ConflictRename} {
+				action := planFile(test.file, existing[test.path], destPath, onConflict)
+				if action.Action != test.actions[i] {
+					t.Errorf("on conflict %s: %s (%s), want %s", onConflict, action.Action, action.Detail, test.actions[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPlanRestoreMirror(t *testing.T) {
+	target := t.TempDir()
+	writeFiles := map[string]string{
+		"keep.txt":      "kept",
+		"changed.txt":   "old content",
+		"extra.txt":     "not in the backup",
+		"sub/extra.txt": "not in the backup",
+		"sub/debug.log": "excluded",
+		"cache/a.txt":   "ignored",
+		".s3diffignore": "cache/\n",
+	}
+	for name, content := range writeFiles {
+		filePath := filepath.Join(target, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(target, "only-dirs", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("keep.txt", filepath.Join(target, "old-link")); err != nil {
+		t.Skipf("symlinks are not supported: %s", err)
+	}
+
+	refDB := db.NewDBInDir(t.TempDir())
+	defer refDB.Close()
+	refDB.InsertSfilesToDB([]*types.SFile{
+		{RelativePath: ".s3diffignore", Size: 7, Archive: "run-1.zip"},
+		{RelativePath: "keep.txt", Size: 4, Archive: "run-1.zip"},
+		{RelativePath: "changed.txt", Size: 3, Archive: "run-1.zip"},
+		{RelativePath: "sub/new.txt", Size: 3, Archive: "run-1.zip"},
+	})
+	committed := map[string]string{"run-1.zip": ""}
+	task := &utils.TaskConfig{Task: utils.Task{ID: "test", Excludes: []string{"**/*.log"}}}
+
+	opts := &RestoreOptions{Target: target, OnConflict: ConflictOverwrite, DryRun: true, Mirror: true}
+	plan, err := planRestore(task, opts, refDB, committed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := []string{}
+	for _, action := range plan.report.Actions {
+		if action.Action == ActionDelete {
+			deleted = append(deleted, action.Path)
+		}
+	}
+	// excluded and ignored files and dirs are left alone
+	want := []string{"extra.txt", "old-link", "sub/extra.txt"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+	for name := range writeFiles {
+		if _, err := os.Lstat(filepath.Join(target, filepath.FromSlash(name))); err != nil {
+			t.Errorf("dry run changed the target: %s", err)
+		}
+	}
+}
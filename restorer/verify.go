@@ -0,0 +1,213 @@
+package restorer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"s3-diff-archive/db"
+	"s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"time"
+)
+
+type VerifyReport struct {
+	TaskID  string    `json:"task_id"`
+	Against string    `json:"against"` // "db" or the restored dir
+	Checked int       `json:"checked"` // paths in the live dir
+	Changes []*Change `json:"changes"`
+}
+
+func (r *VerifyReport) Message() string {
+	counts := map[ChangeKind]int{}
+	for _, change := range r.Changes {
+		counts[change.Kind]++
+	}
+	return fmt.Sprintf("Task: %s, Against: %s, Checked: %d, Added: %d, Modified: %d, Deleted: %d, Type changed: %d",
+		r.TaskID, r.Against, r.Checked, counts[Added], counts[Modified], counts[Deleted], counts[TypeChanged])
+}
+
+// excludeSkip skips the entries the scanner skips by the filters of the task
+// and the ignore files of the tree at root, and by its symlinks and
+// special_files settings. With symlinks: follow, a link still seen as a link
+// is dangling, and the scanner skips those too.
+func excludeSkip(task *utils.TaskConfig, root utils.Root) func(relativePath string, info os.FileInfo) bool {
+	filter := utils.NewFilter(task, root)
+	return func(relativePath string, info os.FileInfo) bool {
+		mode := info.Mode()
+		if mode&os.ModeSymlink != 0 && task.Symlinks != utils.SymlinksStore {
+			return true
+		}
+		if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 && task.SpecialFiles != utils.SpecialFilesRecord {
+			return true
+		}
+		if info.IsDir() {
+			rule, _ := filter.SkipDir(relativePath)
+			return rule != ""
+		}
+		rule, _ := filter.SkipFile(relativePath, info)
+		return rule != ""
+	}
+}
+
+// isSkipped reports whether a path or a dir above it is in skipped.
+func isSkipped(archivePath string, skipped map[string]bool) bool {
+	for dir := archivePath; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if skipped[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// archivedFileType is the fileType a backup entry had when it was archived.
+func archivedFileType(file *types.SFile) string {
+	switch file.Type {
+	case types.FileTypeDir:
+		return "dir"
+	case types.FileTypeSymlink:
+		return "symlink"
+	case types.FileTypeFIFO:
+		return "fifo"
+	case types.FileTypeSocket:
+		return "socket"
+	case types.FileTypeDevice, types.FileTypeChar:
+		return "device"
+	default:
+		return "file"
+	}
+}
+
+// VerifyTask compares the live dirs of the task with its current DB, which
+// needs no zip downloads, or with a restored tree when restoredDir is set.
+// Paths only in the live dirs are added, paths only in the backup deleted.
+// The dirs of a task with several are found in the restored tree under
+// their prefixes, as restore -target lays them out.
+func VerifyTask(task *utils.TaskConfig, restoredDir string) (*VerifyReport, error) {
+	if task.Source == utils.SourceCommand {
+		return nil, fmt.Errorf("task %s archives the output of a command, it has no live dir to verify", task.ID)
+	}
+	if restoredDir != "" {
+		report := &VerifyReport{TaskID: task.ID, Against: restoredDir, Changes: []*Change{}}
+		for _, root := range task.Roots() {
+			skip := excludeSkip(task, root)
+			// the live dir is walked like the scanner walks it, the restored
+			// tree holds what it archived
+			live, err := walkTree(root.Path, task.Symlinks == utils.SymlinksFollow, skip)
+			if err != nil {
+				return nil, err
+			}
+			restoredRoot := filepath.Join(restoredDir, filepath.FromSlash(root.Prefix))
+			restored, err := walkTree(restoredRoot, false, skip)
+			if err != nil {
+				return nil, err
+			}
+			changes := compareTrees(root.Path, restoredRoot, live, restored)
+			for _, change := range changes {
+				change.Path = root.ArchivePath(change.Path)
+				if change.From != "" {
+					change.From = root.ArchivePath(change.From)
+				}
+			}
+			report.Changes = append(report.Changes, changes...)
+			report.Checked += len(live)
+		}
+		sortChanges(report.Changes)
+		return report, nil
+	}
+
+	live := map[string]os.FileInfo{}
+	skipped := map[string]bool{} // live paths the filters skip, by their archive paths
+	filters := []*utils.Filter{}
+	for _, root := range task.Roots() {
+		skip := excludeSkip(task, root)
+		rootLive, err := walkTree(root.Path, task.Symlinks == utils.SymlinksFollow, func(relativePath string, info os.FileInfo) bool {
+			if skip(relativePath, info) {
+				skipped[root.ArchivePath(relativePath)] = true
+				return true
+			}
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+		for relativePath, info := range rootLive {
+			live[root.ArchivePath(relativePath)] = info
+		}
+		filters = append(filters, utils.NewFilter(task, root))
+	}
+	refDB := db.FetchRemoteDB(task)
+	defer refDB.Close()
+
+	report := &VerifyReport{TaskID: task.ID, Against: "db", Checked: len(live), Changes: []*Change{}}
+	archived := map[string]bool{}
+	err := refDB.ForEachSfile(func(file *types.SFile) error {
+		// a backup entry is left alone when its live path, or a dir above
+		// it, was skipped, by any rule, or when its path is skipped and it
+		// has no live path to filter by
+		if isSkipped(file.RelativePath, skipped) {
+			return nil
+		}
+		for i, root := range task.Roots() {
+			if relativePath, ok := root.Contains(file.RelativePath); ok {
+				if rule, _ := filters[i].SkipEntry(relativePath); rule != "" {
+					return nil
+				}
+				break
+			}
+		}
+		archived[file.RelativePath] = true
+		info, ok := live[file.RelativePath]
+		if !ok {
+			report.Changes = append(report.Changes, &Change{Path: file.RelativePath, Kind: Deleted})
+			return nil
+		}
+		archivedType := archivedFileType(file)
+		if fileType(info) != archivedType {
+			report.Changes = append(report.Changes, &Change{Path: file.RelativePath, Kind: TypeChanged, Detail: archivedType + " -> " + fileType(info)})
+			return nil
+		}
+		if file.Type == types.FileTypeSymlink {
+			target, err := os.Readlink(task.SourcePath(file.RelativePath))
+			if err != nil {
+				return err
+			}
+			if target != file.Target {
+				report.Changes = append(report.Changes, &Change{Path: file.RelativePath, Kind: Modified, Detail: fmt.Sprintf("target %s -> %s", file.Target, target)})
+			}
+			return nil
+		}
+		isFile := file.Type != types.FileTypeDir
+		switch {
+		case isFile && info.Size() != file.Size:
+			report.Changes = append(report.Changes, &Change{Path: file.RelativePath, Kind: Modified, Detail: fmt.Sprintf("size %d -> %d", file.Size, info.Size())})
+		case isFile && info.ModTime().Unix() != file.Mtime:
+			// the scanner treats any mtime change as a change
+			report.Changes = append(report.Changes, &Change{Path: file.RelativePath, Kind: Modified, Detail: fmt.Sprintf("mtime %s -> %s", time.Unix(file.Mtime, 0).Format(time.RFC3339), info.ModTime().Format(time.RFC3339))})
+		case file.Meta != nil:
+			meta, err := utils.ReadFileMeta(task.SourcePath(file.RelativePath), info)
+			if err != nil {
+				return err
+			}
+			if !meta.Equal(file.Meta) {
+				report.Changes = append(report.Changes, &Change{Path: file.RelativePath, Kind: Modified, Detail: "metadata"})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for relativePath, info := range live {
+		if info.IsDir() || archived[relativePath] {
+			continue
+		}
+		change := &Change{Path: relativePath, Kind: Added}
+		if !info.Mode().IsRegular() {
+			change.Detail = fileType(info)
+		}
+		report.Changes = append(report.Changes, change)
+	}
+	sortChanges(report.Changes)
+	return report, nil
+}
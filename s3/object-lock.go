@@ -0,0 +1,60 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	nTypes "s3-diff-archive/types"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type objectLock struct {
+	mode        types.ObjectLockMode
+	retainUntil *time.Time
+	legalHold   types.ObjectLockLegalHoldStatus
+}
+
+// objectLockFor returns the retention to set on an object uploaded now.
+func objectLockFor(cnfg *nTypes.S3Config) objectLock {
+	lock := objectLock{}
+	if cnfg.ObjectLockMode != "" {
+		lock.mode = cnfg.ObjectLockMode
+		lock.retainUntil = aws.Time(time.Now().UTC().AddDate(0, 0, cnfg.ObjectLockDays))
+	}
+	if cnfg.LegalHold {
+		lock.legalHold = types.ObjectLockLegalHoldStatusOn
+	}
+	return lock
+}
+
+func applyObjectLockToPut(cnfg *nTypes.S3Config, in *s3.PutObjectInput) {
+	lock := objectLockFor(cnfg)
+	in.ObjectLockMode, in.ObjectLockRetainUntilDate, in.ObjectLockLegalHoldStatus = lock.mode, lock.retainUntil, lock.legalHold
+}
+
+func applyObjectLockToCreateMultipart(cnfg *nTypes.S3Config, in *s3.CreateMultipartUploadInput) {
+	lock := objectLockFor(cnfg)
+	in.ObjectLockMode, in.ObjectLockRetainUntilDate, in.ObjectLockLegalHoldStatus = lock.mode, lock.retainUntil, lock.legalHold
+}
+
+// CheckObjectLock verifies that the bucket has Object Lock enabled, without
+// which S3 rejects uploads that ask for retention.
+func CheckObjectLock(cnfg *nTypes.S3Config, ctx context.Context) error {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return err
+	}
+	resp, err := s3Client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(cnfg.S3Bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("object lock is not enabled on bucket %s: %w", cnfg.S3Bucket, err)
+	}
+	if resp.ObjectLockConfiguration == nil || resp.ObjectLockConfiguration.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		return fmt.Errorf("object lock is not enabled on bucket %s", cnfg.S3Bucket)
+	}
+	return nil
+}
@@ -2,14 +2,17 @@ package s3
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	lg "s3-diff-archive/logger"
+	"s3-diff-archive/utils"
 	"strings"
-
-	"bytes"
+	"sync"
 
 	nTypes "s3-diff-archive/types"
 
@@ -20,19 +23,50 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-const multipartThreshold = 100 * 1024 * 1024 // 100 MB
+const (
+	checksumMetadataKey = "sha256"
+	multipartThreshold  = 100 * 1024 * 1024 // 100 MB
+	defaultPartSize     = 90 * 1024 * 1024  // 90 MB
+	minPartSize         = 5 * 1024 * 1024   // 5 MB, S3 minimum for all but the last part
+	maxParts            = 10000
+)
 
-// UploadFileToS3 uploads a file to S3 using PutObject or Multipart depending on size.
-func UploadFileToS3(cnfg *nTypes.S3Config, ctx context.Context, nKey string, filePath string) error {
+func hexToBase64(checksum string) (string, error) {
+	raw, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum %s: %w", checksum, err)
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func newClient(ctx context.Context, cnfg *nTypes.S3Config) (*s3.Client, error) {
 	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(cnfg.Region),
 		config.WithCredentialsProvider(
 			credentials.NewStaticCredentialsProvider(cnfg.AccessKeyID, cnfg.SecretAccessKey, ""),
 		))
 	if err != nil {
-		return fmt.Errorf("unable to load AWS config: %w", err)
+		return nil, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+	return s3.NewFromConfig(cfg), nil
+}
+
+// UploadFileToS3 uploads a file to S3 using PutObject or Multipart depending on size.
+// checksum is the hex SHA-256 of the file; it is computed when empty. S3
+// verifies it on arrival and it is kept in the object metadata so every
+// download can be verified against it.
+func UploadFileToS3(cnfg *nTypes.S3Config, ctx context.Context, nKey string, filePath string, checksum string) error {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return err
+	}
+
+	if checksum == "" {
+		checksum, err = utils.FileSHA256(filePath)
+		if err != nil {
+			return fmt.Errorf("unable to checksum file: %w", err)
+		}
 	}
-	s3Client := s3.NewFromConfig(cfg)
 
 	cnfg.S3BasePath = strings.TrimSuffix(cnfg.S3BasePath, "/")
 	key := cnfg.S3BasePath + "/" + nKey
@@ -56,16 +90,27 @@ func UploadFileToS3(cnfg *nTypes.S3Config, ctx context.Context, nKey string, fil
 	// Use Multipart Upload if file is large
 	if fileSize > multipartThreshold {
 		lg.Logs.Info("Using multipart upload")
-		return multipartUpload(ctx, s3Client, file, fileSize, cnfg.S3Bucket, key, cnfg.StorageClass)
+		return multipartUpload(ctx, s3Client, file, fileInfo, cnfg, key, checksum)
+	}
+
+	checksumB64, err := hexToBase64(checksum)
+	if err != nil {
+		return err
 	}
 
 	// Small file: use PutObject
-	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:       aws.String(cnfg.S3Bucket),
-		Key:          aws.String(key),
-		Body:         file,
-		StorageClass: cnfg.StorageClass,
-	})
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(cnfg.S3Bucket),
+		Key:               aws.String(key),
+		Body:              file,
+		StorageClass:      cnfg.StorageClass,
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(checksumB64),
+		Metadata:          map[string]string{checksumMetadataKey: checksum},
+	}
+	applySSEToPut(cnfg, input)
+	applyObjectLockToPut(cnfg, input)
+	_, err = s3Client.PutObject(ctx, input)
 	if err != nil {
 		return fmt.Errorf("PutObject failed: %w", err)
 	}
@@ -74,101 +119,203 @@ func UploadFileToS3(cnfg *nTypes.S3Config, ctx context.Context, nKey string, fil
 	return nil
 }
 
-func multipartUpload(ctx context.Context, client *s3.Client, file *os.File, fileSize int64, bucket, key string, sc types.StorageClass) (err error) {
-	const partSize = int64(90 * 1024 * 1024) // 90 MB
-
-	var parts []types.CompletedPart
-	partNumber := int32(1)
-
-	// Step 1: initiate multipart upload
-	createResp, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
-		Bucket:       aws.String(bucket),
-		Key:          aws.String(key),
-		StorageClass: sc,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to initiate multipart upload: %w", err)
+// multipartUpload uploads the file in parts. Progress is saved in the state
+// dir after every part, so an upload interrupted by a crash or an error is
+// resumed by the next call for the same key and file instead of restarting.
+func multipartUpload(ctx context.Context, client *s3.Client, file *os.File, fileInfo os.FileInfo, cnfg *nTypes.S3Config, key string, checksum string) (err error) {
+	fileSize := fileInfo.Size()
+	partSize := multipartPartSize(cnfg.PartSize, fileSize)
+	concurrency := max(cnfg.Concurrency, 1)
+	uploaded := map[int32]types.Part{}
+
+	// Step 1: resume an unfinished upload or initiate a new one
+	state := loadUploadState(ctx, client, cnfg, key, fileInfo, file.Name())
+	if state != nil {
+		uploaded, err = listUploadedParts(ctx, client, cnfg, key, state.UploadID)
+		if err != nil {
+			lg.Logs.Warn("Cannot resume upload %s of %s, starting over: %s", state.UploadID, key, err.Error())
+			abortUpload(ctx, client, cnfg.S3Bucket, key, state.UploadID)
+			state.remove()
+			state = nil
+			uploaded = map[int32]types.Part{}
+		} else {
+			partSize = state.PartSize
+			lg.Logs.Info("Resuming upload %s of %s, %d parts already uploaded", state.UploadID, key, len(uploaded))
+		}
 	}
-	uploadID := createResp.UploadId
-
-	defer func() {
+	if state == nil {
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(cnfg.S3Bucket),
+			Key:               aws.String(key),
+			StorageClass:      cnfg.StorageClass,
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			Metadata:          map[string]string{checksumMetadataKey: checksum},
+		}
+		applySSEToCreateMultipart(cnfg, input)
+		applyObjectLockToCreateMultipart(cnfg, input)
+		createResp, err := client.CreateMultipartUpload(ctx, input)
 		if err != nil {
-			client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
-				Bucket:   aws.String(bucket),
-				Key:      aws.String(key),
-				UploadId: uploadID,
-			})
+			return fmt.Errorf("failed to initiate multipart upload: %w", err)
 		}
-	}()
+		state = newUploadState(cnfg, key, aws.ToString(createResp.UploadId), file.Name(), fileInfo, partSize)
+		state.save()
+	}
+	uploadID := aws.String(state.UploadID)
 
 	totalParts := int32(fileSize / partSize)
 	if fileSize%partSize != 0 {
 		totalParts++
 	}
-	// Step 2: upload parts
-	for offset := int64(0); offset < fileSize; offset += partSize {
-		curPartSize := partSize
-		if offset+curPartSize > fileSize {
-			curPartSize = fileSize - offset
+	concurrency = min(concurrency, int(totalParts))
+
+	parts := make([]types.CompletedPart, totalParts)
+	progress := newUploadProgress(key, fileSize, totalParts)
+	pending := []int32{}
+	state.Parts = []uploadedPart{}
+	for partNumber := int32(1); partNumber <= totalParts; partNumber++ {
+		curPartSize := min(partSize, fileSize-int64(partNumber-1)*partSize)
+		if part, ok := uploaded[partNumber]; ok && aws.ToInt64(part.Size) == curPartSize {
+			parts[partNumber-1] = types.CompletedPart{ETag: part.ETag, ChecksumSHA256: part.ChecksumSHA256, PartNumber: aws.Int32(partNumber)}
+			state.Parts = append(state.Parts, uploadedPart{PartNumber: partNumber, ETag: aws.ToString(part.ETag)})
+			progress.partDone(partNumber, curPartSize)
+			continue
 		}
+		pending = append(pending, partNumber)
+	}
+	state.save()
+
+	lg.Logs.Info("Uploading (%s) %d of %d parts of %d MB, %d in parallel", key, len(pending), totalParts, partSize/1024/1024, concurrency)
+
+	// Step 2: upload parts. Every worker borrows a buffer from the pool, so at
+	// most `concurrency` parts are held in memory at any time.
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pool := newPartBufferPool(concurrency, partSize)
+	partNumbers := make(chan int32)
+	errs := make(chan error, concurrency)
+
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				part, err := uploadPart(uploadCtx, client, cnfg, file, fileSize, partSize, partNumber, key, uploadID, pool, progress)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				parts[partNumber-1] = part
+				state.addPart(partNumber, aws.ToString(part.ETag))
+			}
+		}()
+	}
 
-		partBuf := make([]byte, curPartSize)
-		_, err := file.ReadAt(partBuf, offset)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read file chunk: %w", err)
-		}
-
-		partResp, err := client.UploadPart(ctx, &s3.UploadPartInput{
-			Bucket:     aws.String(bucket),
-			Key:        aws.String(key),
-			UploadId:   uploadID,
-			PartNumber: aws.Int32(partNumber),
-
-			// Body: bytesReader(partBuf),
-			Body: bytes.NewReader(partBuf),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	stopProgress := progress.start()
+feed:
+	for _, partNumber := range pending {
+		select {
+		case partNumbers <- partNumber:
+		case <-uploadCtx.Done():
+			break feed
 		}
+	}
+	close(partNumbers)
+	wg.Wait()
+	stopProgress()
 
-		parts = append(parts, types.CompletedPart{
-			ETag:       partResp.ETag,
-			PartNumber: aws.Int32(partNumber),
-		})
-
-		lg.Logs.Info("Uploading (%s) part %d/%d (%.2f%%)", key, partNumber, totalParts, float64(offset+curPartSize)*100/float64(fileSize))
-		partNumber++
+	select {
+	case err = <-errs:
+		lg.Logs.Warn("Upload %s of %s interrupted, it will be resumed on the next run", state.UploadID, key)
+		return err
+	default:
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
 	// Step 3: complete multipart upload
-	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
-		Bucket:   aws.String(bucket),
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(cnfg.S3Bucket),
 		Key:      aws.String(key),
 		UploadId: uploadID,
 		MultipartUpload: &types.CompletedMultipartUpload{
 			Parts: parts,
 		},
-	})
+	}
+	applySSEToCompleteMultipart(cnfg, completeInput)
+	_, err = client.CompleteMultipartUpload(ctx, completeInput)
 
 	if err != nil {
 		return fmt.Errorf("failed to complete multipart upload: %w", err)
 	}
+	state.remove()
 
-	lg.Logs.Info("Uploaded (multipart): %s -> s3://%s/%s\n", file.Name(), bucket, key)
+	lg.Logs.Info("Uploaded (multipart): %s -> s3://%s/%s", file.Name(), cnfg.S3Bucket, key)
 	return nil
 }
 
+func uploadPart(ctx context.Context, client *s3.Client, cnfg *nTypes.S3Config, file *os.File, fileSize, partSize int64, partNumber int32, key string, uploadID *string, pool *partBufferPool, progress *uploadProgress) (types.CompletedPart, error) {
+	offset := int64(partNumber-1) * partSize
+	curPartSize := min(partSize, fileSize-offset)
+
+	buf := pool.get()
+	defer pool.put(buf)
+	partBuf := buf[:curPartSize]
+
+	_, err := file.ReadAt(partBuf, offset)
+	if err != nil && err != io.EOF {
+		return types.CompletedPart{}, fmt.Errorf("failed to read file chunk: %w", err)
+	}
+	partChecksum := sha256.Sum256(partBuf)
+
+	input := &s3.UploadPartInput{
+		Bucket:            aws.String(cnfg.S3Bucket),
+		Key:               aws.String(key),
+		UploadId:          uploadID,
+		PartNumber:        aws.Int32(partNumber),
+		Body:              progress.reader(partNumber, partBuf),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(base64.StdEncoding.EncodeToString(partChecksum[:])),
+	}
+	applySSEToUploadPart(cnfg, input)
+	partResp, err := client.UploadPart(ctx, input)
+	if err != nil {
+		return types.CompletedPart{}, fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+	progress.partDone(partNumber, curPartSize)
+
+	return types.CompletedPart{
+		ETag:           partResp.ETag,
+		ChecksumSHA256: partResp.ChecksumSHA256,
+		PartNumber:     aws.Int32(partNumber),
+	}, nil
+}
+
+// multipartPartSize returns the configured part size, grown when needed so
+// that the file fits in the maximum number of parts S3 accepts.
+func multipartPartSize(configured, fileSize int64) int64 {
+	partSize := configured
+	if partSize < minPartSize {
+		partSize = defaultPartSize
+	}
+	if fileSize/partSize >= maxParts {
+		partSize = fileSize/(maxParts-1) + 1
+	}
+	return partSize
+}
+
 // DownloadFileFromS3 downloads a file from S3 and saves it to the specified local path.
-func DownloadFileFromS3(cnfg *nTypes.S3Config, ctx context.Context, nKey, destinationPath string) (err error) {
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(cnfg.Region),
-		config.WithCredentialsProvider(
-			credentials.NewStaticCredentialsProvider(cnfg.AccessKeyID, cnfg.SecretAccessKey, ""),
-		))
+// The download is verified against checksum, the hex SHA-256 of the file, or
+// against the checksum stored in the object metadata when checksum is empty.
+// A mismatch removes the file and returns an error.
+func DownloadFileFromS3(cnfg *nTypes.S3Config, ctx context.Context, nKey, destinationPath string, checksum string) (err error) {
+	s3Client, err := newClient(ctx, cnfg)
 	if err != nil {
-		return fmt.Errorf("unable to load AWS config: %w", err)
+		return err
 	}
-	s3Client := s3.NewFromConfig(cfg)
 
 	cnfg.S3BasePath = strings.TrimSuffix(cnfg.S3BasePath, "/")
 	key := cnfg.S3BasePath + "/" + nKey
@@ -176,10 +323,13 @@ func DownloadFileFromS3(cnfg *nTypes.S3Config, ctx context.Context, nKey, destin
 	lg.Logs.Info("Downloading: %s", key)
 
 	// Get object from S3
-	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &cnfg.S3Bucket,
-		Key:    &key,
-	})
+	input := &s3.GetObjectInput{
+		Bucket:       &cnfg.S3Bucket,
+		Key:          &key,
+		ChecksumMode: types.ChecksumModeEnabled,
+	}
+	applySSEToGet(cnfg, input)
+	resp, err := s3Client.GetObject(ctx, input)
 
 	// check if file exists
 	if err != nil {
@@ -209,11 +359,98 @@ func DownloadFileFromS3(cnfg *nTypes.S3Config, ctx context.Context, nKey, destin
 	defer outFile.Close()
 
 	// Write S3 content to file
-	_, err = io.Copy(outFile, resp.Body)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(outFile, hash), resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
 
+	if checksum == "" {
+		checksum = resp.Metadata[checksumMetadataKey]
+	}
+	if checksum == "" {
+		lg.Logs.Warn("No checksum recorded for %s, download not verified", key)
+	} else if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		outFile.Close()
+		_ = os.Remove(destinationPath)
+		return fmt.Errorf("checksum mismatch for s3://%s/%s: expected %s, got %s", cnfg.S3Bucket, key, checksum, actual)
+	}
+
 	lg.Logs.Info("Downloaded s3://%s/%s to %s", cnfg.S3Bucket, key, destinationPath)
 	return nil
 }
+
+// HeadFileInS3 returns the metadata of an object without downloading it, or
+// a "not-found" error when it does not exist.
+func HeadFileInS3(cnfg *nTypes.S3Config, ctx context.Context, nKey string) (*s3.HeadObjectOutput, error) {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimSuffix(cnfg.S3BasePath, "/") + "/" + nKey
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(cnfg.S3Bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}
+	applySSEToHead(cnfg, input)
+	resp, err := s3Client.HeadObject(ctx, input)
+	if err != nil {
+		if strings.Contains(err.Error(), "StatusCode: 404") {
+			return nil, fmt.Errorf("not-found")
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ListFilesInS3 lists the objects whose key starts with prefix, relative to
+// the base path.
+func ListFilesInS3(cnfg *nTypes.S3Config, ctx context.Context, prefix string) ([]*nTypes.S3Object, error) {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return nil, err
+	}
+
+	basePath := strings.TrimSuffix(cnfg.S3BasePath, "/") + "/"
+	objects := []*nTypes.S3Object{}
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(cnfg.S3Bucket),
+		Prefix: aws.String(basePath + prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", cnfg.S3Bucket, basePath+prefix, err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, &nTypes.S3Object{
+				Key:          strings.TrimPrefix(aws.ToString(object.Key), basePath),
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+				StorageClass: object.StorageClass,
+			})
+		}
+	}
+	return objects, nil
+}
+
+// DeleteFileFromS3 deletes an object. Deleting a missing object is not an error.
+func DeleteFileFromS3(cnfg *nTypes.S3Config, ctx context.Context, nKey string) error {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimSuffix(cnfg.S3BasePath, "/") + "/" + nKey
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(cnfg.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete s3://%s/%s: %w", cnfg.S3Bucket, key, err)
+	}
+	lg.Logs.Info("Deleted: s3://%s/%s", cnfg.S3Bucket, key)
+	return nil
+}
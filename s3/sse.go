@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	nTypes "s3-diff-archive/types"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sseCustomer holds the SSE-C headers. S3 needs them on every request that
+// reads or writes an object encrypted with a customer key.
+type sseCustomer struct {
+	algorithm *string
+	key       *string
+	keyMD5    *string
+}
+
+func customerKey(cnfg *nTypes.S3Config) sseCustomer {
+	if len(cnfg.SSECustomerKey) == 0 {
+		return sseCustomer{}
+	}
+	sum := md5.Sum(cnfg.SSECustomerKey)
+	return sseCustomer{
+		algorithm: aws.String("AES256"),
+		key:       aws.String(base64.StdEncoding.EncodeToString(cnfg.SSECustomerKey)),
+		keyMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+}
+
+func kmsKeyID(cnfg *nTypes.S3Config) *string {
+	if cnfg.SSEKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(cnfg.SSEKMSKeyID)
+}
+
+func applySSEToPut(cnfg *nTypes.S3Config, in *s3.PutObjectInput) {
+	c := customerKey(cnfg)
+	in.ServerSideEncryption = cnfg.SSE
+	in.SSEKMSKeyId = kmsKeyID(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
+
+func applySSEToCreateMultipart(cnfg *nTypes.S3Config, in *s3.CreateMultipartUploadInput) {
+	c := customerKey(cnfg)
+	in.ServerSideEncryption = cnfg.SSE
+	in.SSEKMSKeyId = kmsKeyID(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
+
+func applySSEToUploadPart(cnfg *nTypes.S3Config, in *s3.UploadPartInput) {
+	c := customerKey(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
+
+func applySSEToCompleteMultipart(cnfg *nTypes.S3Config, in *s3.CompleteMultipartUploadInput) {
+	c := customerKey(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
+
+func applySSEToListParts(cnfg *nTypes.S3Config, in *s3.ListPartsInput) {
+	c := customerKey(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
+
+func applySSEToGet(cnfg *nTypes.S3Config, in *s3.GetObjectInput) {
+	c := customerKey(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
+
+func applySSEToHead(cnfg *nTypes.S3Config, in *s3.HeadObjectInput) {
+	c := customerKey(cnfg)
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = c.algorithm, c.key, c.keyMD5
+}
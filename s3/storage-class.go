@@ -0,0 +1,93 @@
+package s3
+
+import (
+	"context"
+	nTypes "s3-diff-archive/types"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// minStorageDays is how long S3 bills an object of a storage class for, even
+// if it is deleted or overwritten sooner.
+var minStorageDays = map[types.StorageClass]int{
+	types.StorageClassStandardIa:         30,
+	types.StorageClassOnezoneIa:          30,
+	types.StorageClassGlacierIr:          90,
+	types.StorageClassGlacier:            90,
+	types.StorageClassDeepArchive:        180,
+	types.StorageClassIntelligentTiering: 0,
+	types.StorageClassStandard:           0,
+}
+
+// MinStorageDuration returns the minimum billed storage duration of a
+// storage class, zero for classes without one.
+func MinStorageDuration(class types.StorageClass) time.Duration {
+	return time.Duration(minStorageDays[class]) * 24 * time.Hour
+}
+
+// EarliestFreeDeletion returns when an object of the storage class uploaded
+// at uploadedAt can be deleted without an early deletion charge.
+func EarliestFreeDeletion(class types.StorageClass, uploadedAt time.Time) time.Time {
+	return uploadedAt.Add(MinStorageDuration(class))
+}
+
+// NeedsRestore reports whether objects of the storage class must be restored
+// before they can be downloaded.
+func NeedsRestore(class types.StorageClass) bool {
+	return class == types.StorageClassGlacier || class == types.StorageClassDeepArchive
+}
+
+type RestoreState int
+
+const (
+	RestoreNotRequested RestoreState = iota
+	RestoreInProgress
+	RestoreAvailable
+)
+
+// ObjectRestoreState tells whether an object can be downloaded, or whether a
+// restore of it from a cold storage class is still needed or in progress.
+func ObjectRestoreState(cnfg *nTypes.S3Config, ctx context.Context, nKey string) (RestoreState, error) {
+	head, err := HeadFileInS3(cnfg, ctx, nKey)
+	if err != nil {
+		return RestoreNotRequested, err
+	}
+	if !NeedsRestore(types.StorageClass(head.StorageClass)) {
+		return RestoreAvailable, nil
+	}
+	restore := aws.ToString(head.Restore)
+	switch {
+	case restore == "":
+		return RestoreNotRequested, nil
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return RestoreInProgress, nil
+	default:
+		return RestoreAvailable, nil
+	}
+}
+
+// RequestRestore asks S3 to make a temporary copy of a cold object available
+// for the given number of days.
+func RequestRestore(cnfg *nTypes.S3Config, ctx context.Context, nKey string, days int32, tier types.Tier) error {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSuffix(cnfg.S3BasePath, "/") + "/" + nKey
+	_, err = s3Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(cnfg.S3Bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: tier},
+		},
+	})
+	if err != nil && strings.Contains(err.Error(), "RestoreAlreadyInProgress") {
+		return nil
+	}
+	return err
+}
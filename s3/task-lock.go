@@ -0,0 +1,311 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	lg "s3-diff-archive/logger"
+	nTypes "s3-diff-archive/types"
+	"s3-diff-archive/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TaskLockKey is the key of the lock object of a task, relative to its base path.
+const TaskLockKey = "lock.json"
+
+// LockInfo is the content of a task lock object.
+type LockInfo struct {
+	Token      string    `json:"token"`
+	Owner      string    `json:"owner"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	Command    string    `json:"command"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (l *LockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d, %s) since %s, expires %s", l.Owner, l.Hostname, l.PID, l.Command, l.AcquiredAt.Format(time.RFC3339), l.ExpiresAt.Format(time.RFC3339))
+}
+
+// TaskLock is a lock object in the bucket that keeps two hosts from changing
+// the same task at once. It is created with a conditional write, so only one
+// of two concurrent writers succeeds, and kept alive by a heartbeat that
+// pushes its expiry forward. A lock whose holder stopped heartbeating can be
+// taken over once it expires.
+type TaskLock struct {
+	cnfg   *nTypes.S3Config
+	client *s3.Client
+	key    string
+	ttl    time.Duration
+	info   LockInfo
+
+	mu      sync.Mutex
+	etag    string
+	expires time.Time // expiry of the last lock object written
+	err     error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// AcquireTaskLock takes the lock of the task whose base path cnfg points to.
+func AcquireTaskLock(cnfg *nTypes.S3Config, ctx context.Context, ttl time.Duration) (*TaskLock, error) {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := "unknown"
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+	hostname, _ := os.Hostname()
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	now := time.Now().UTC()
+	lock := &TaskLock{
+		cnfg:   cnfg,
+		client: s3Client,
+		key:    strings.TrimSuffix(cnfg.S3BasePath, "/") + "/" + TaskLockKey,
+		ttl:    ttl,
+		info: LockInfo{
+			Token:      utils.GenerateRandString(16),
+			Owner:      owner,
+			Hostname:   hostname,
+			PID:        os.Getpid(),
+			Command:    command,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(ttl),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	// only succeeds if no lock object exists
+	err = lock.put(ctx, "*", "")
+	if isPreconditionFailed(err) {
+		current, etag, getErr := lock.fetch(ctx)
+		if getErr != nil {
+			return nil, fmt.Errorf("task is locked and the lock cannot be read: %w", getErr)
+		}
+		if time.Now().Before(current.ExpiresAt) {
+			return nil, fmt.Errorf("task is locked by %s", current.String())
+		}
+		lg.Logs.Warn("Taking over expired lock held by %s", current.String())
+		// only succeeds if nobody else took it over in the meantime
+		err = lock.put(ctx, "", etag)
+		if isPreconditionFailed(err) {
+			return nil, errLockTakenOver
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire task lock: %w", err)
+	}
+
+	lg.Logs.Info("Acquired lock s3://%s/%s, expires %s", cnfg.S3Bucket, lock.key, lock.info.ExpiresAt.Format(time.RFC3339))
+	go lock.heartbeat()
+	return lock, nil
+}
+
+// put writes the lock object, either if none exists (ifNoneMatch "*") or if
+// the current one has the given etag.
+func (l *TaskLock) put(ctx context.Context, ifNoneMatch, ifMatch string) error {
+	body, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(l.cnfg.S3Bucket),
+		Key:         aws.String(l.key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+	if ifMatch != "" {
+		input.IfMatch = aws.String(ifMatch)
+	}
+	applySSEToPut(l.cnfg, input)
+	resp, err := l.client.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.etag = aws.ToString(resp.ETag)
+	l.expires = l.info.ExpiresAt
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *TaskLock) fetch(ctx context.Context) (*LockInfo, string, error) {
+	return fetchLock(ctx, l.client, l.cnfg, l.key)
+}
+
+func fetchLock(ctx context.Context, client *s3.Client, cnfg *nTypes.S3Config, key string) (*LockInfo, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(cnfg.S3Bucket),
+		Key:    aws.String(key),
+	}
+	applySSEToGet(cnfg, input)
+	resp, err := client.GetObject(ctx, input)
+	if err != nil {
+		if strings.Contains(err.Error(), "StatusCode: 404") {
+			return nil, "", fmt.Errorf("not-found")
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, "", fmt.Errorf("invalid lock object: %w", err)
+	}
+	return &info, aws.ToString(resp.ETag), nil
+}
+
+// heartbeat renews the lock every third of its ttl. A renewal that fails is
+// retried on the next tick; the lock is only given up when another host took
+// it over or when it would expire before the next try.
+func (l *TaskLock) heartbeat() {
+	defer close(l.done)
+	interval := l.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.renew(interval)
+			if err == nil {
+				continue
+			}
+			l.mu.Lock()
+			expires := l.expires
+			l.mu.Unlock()
+			if !errors.Is(err, errLockTakenOver) && time.Now().Add(interval).Before(expires) {
+				lg.Logs.Warn("Failed to renew task lock s3://%s/%s, retrying: %s", l.cnfg.S3Bucket, l.key, err.Error())
+				continue
+			}
+			lg.Logs.Error("Lost task lock s3://%s/%s: %s", l.cnfg.S3Bucket, l.key, err.Error())
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// errLockTakenOver is returned when the lock object is no longer ours.
+var errLockTakenOver = fmt.Errorf("task lock was taken over by another host")
+
+// renew pushes the expiry of the lock forward, if the lock object is still
+// the one last written.
+func (l *TaskLock) renew(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	l.mu.Lock()
+	etag := l.etag
+	l.info.ExpiresAt = time.Now().UTC().Add(l.ttl)
+	l.mu.Unlock()
+
+	err := l.put(ctx, "", etag)
+	if !isPreconditionFailed(err) {
+		return err
+	}
+	// a renewal that timed out may still have been written, in which case
+	// the lock object is ours with another etag
+	current, currentETag, fetchErr := l.fetch(ctx)
+	if fetchErr != nil {
+		if fetchErr.Error() == "not-found" {
+			return errLockTakenOver
+		}
+		return fetchErr
+	}
+	if current.Token != l.info.Token {
+		return errLockTakenOver
+	}
+	l.mu.Lock()
+	l.etag = currentETag
+	l.expires = current.ExpiresAt
+	l.mu.Unlock()
+	return l.put(ctx, "", currentETag)
+}
+
+// Err returns why the lock was lost, or nil while it is held. Callers check
+// it before committing changes to the task.
+func (l *TaskLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Release stops the heartbeat and deletes the lock object if it is still ours.
+func (l *TaskLock) Release() {
+	close(l.stop)
+	<-l.done
+	if l.Err() != nil {
+		return
+	}
+
+	current, etag, err := l.fetch(context.TODO())
+	if err != nil || current.Token != l.info.Token {
+		lg.Logs.Warn("Task lock s3://%s/%s is no longer ours, leaving it", l.cnfg.S3Bucket, l.key)
+		return
+	}
+	// only deletes the object just read, not one another host wrote since
+	_, err = l.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket:  aws.String(l.cnfg.S3Bucket),
+		Key:     aws.String(l.key),
+		IfMatch: aws.String(etag),
+	})
+	if isPreconditionFailed(err) {
+		lg.Logs.Warn("Task lock s3://%s/%s is no longer ours, leaving it", l.cnfg.S3Bucket, l.key)
+		return
+	}
+	if err != nil {
+		lg.Logs.Warn("Failed to release task lock s3://%s/%s: %s", l.cnfg.S3Bucket, l.key, err.Error())
+		return
+	}
+	lg.Logs.Info("Released lock s3://%s/%s", l.cnfg.S3Bucket, l.key)
+}
+
+// FetchTaskLock returns the current lock of the task, or a "not-found" error
+// when it is not locked.
+func FetchTaskLock(cnfg *nTypes.S3Config, ctx context.Context) (*LockInfo, error) {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return nil, err
+	}
+	info, _, err := fetchLock(ctx, s3Client, cnfg, strings.TrimSuffix(cnfg.S3BasePath, "/")+"/"+TaskLockKey)
+	return info, err
+}
+
+// ForceUnlockTask deletes the lock of the task regardless of its holder.
+func ForceUnlockTask(cnfg *nTypes.S3Config, ctx context.Context) error {
+	return DeleteFileFromS3(cnfg, ctx, TaskLockKey)
+}
+
+// isPreconditionFailed reports whether a conditional write lost: 412 when the
+// condition did not hold, 409 when a concurrent conditional write won.
+func isPreconditionFailed(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "StatusCode: 412") || strings.Contains(err.Error(), "StatusCode: 409"))
+}
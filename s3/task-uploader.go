@@ -2,39 +2,120 @@ package s3
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
 	lg "s3-diff-archive/logger"
+	nTypes "s3-diff-archive/types"
 	"s3-diff-archive/utils"
+	"slices"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// TaskUploader uploads the zips and the DB of an archive run. Its state is
+// saved in the working dir until Finish is called, so a run that crashed
+// midway can be picked up again with LoadPendingUpload.
 type TaskUploader struct {
-	Task          *utils.TaskConfig
-	ArchivedFiles []string
-	DBZipPath     string
+	Task          *utils.TaskConfig `json:"-"`
+	RunID         string            `json:"run_id"`
+	ArchivedFiles []*nTypes.Archive `json:"archived_files"`
+	DBZip         *nTypes.Archive   `json:"db_zip"`
+	DBKey         string            `json:"db_key"`  // key the DB zip is uploaded to
+	Changed       bool              `json:"changed"` // the DB records changes, even if no file was zipped
+	Uploaded      []string          `json:"uploaded"`
+}
+
+func pendingUploadPath(task *utils.TaskConfig) string {
+	return filepath.Join(task.WorkingDir, task.ID, "pending-upload.json")
+}
+
+// LoadPendingUpload returns the uploader of a previous run of the task that
+// did not finish, or nil if there is none.
+func LoadPendingUpload(task *utils.TaskConfig) (*TaskUploader, error) {
+	data, err := os.ReadFile(pendingUploadPath(task))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	uploader := &TaskUploader{}
+	if err := json.Unmarshal(data, uploader); err != nil {
+		return nil, err
+	}
+	uploader.Task = task
+	return uploader, nil
+}
+
+// Save records the uploader in the working dir so it can be resumed.
+func (t *TaskUploader) Save() error {
+	statePath := pendingUploadPath(t.Task)
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+// Finish removes the saved state once the run is fully recorded.
+func (t *TaskUploader) Finish() {
+	_ = os.Remove(pendingUploadPath(t.Task))
+}
+
+func (t *TaskUploader) markUploaded(file string) error {
+	t.Uploaded = append(t.Uploaded, file)
+	return t.Save()
 }
 
 func (t *TaskUploader) Upload() error {
-	if len(t.ArchivedFiles) == 0 {
+	// links, empty dirs and metadata only live in the DB, so a run that
+	// changed only those still uploads it
+	if len(t.ArchivedFiles) == 0 && !t.Changed {
 		lg.Logs.Info("No files to upload in task %s. Continuing...", t.Task.ID)
 		return nil
 	}
 	lg.Logs.Info("Uploading task %s, files: %d", t.Task.ID, len(t.ArchivedFiles))
 	for _, file := range t.ArchivedFiles {
-		err := UploadFileToS3(t.Task.CreateS3Config(t.Task.StorageClass), context.TODO(), utils.FileNameFromPath(file), file)
+		if slices.Contains(t.Uploaded, file.Path) {
+			lg.Logs.Info("Already uploaded: %s", file.Path)
+			continue
+		}
+		err := UploadFileToS3(t.Task.CreateS3Config(t.Task.StorageClass), context.TODO(), utils.FileNameFromPath(file.Path), file.Path, file.SHA256)
 		if err != nil {
 			return err
 		}
+		if err := t.markUploaded(file.Path); err != nil {
+			return err
+		}
 	}
-	err := UploadFileToS3(t.Task.CreateS3Config(types.StorageClassStandard), context.TODO(), "db.zip", t.DBZipPath)
-	if err != nil {
-		return err
+	if !slices.Contains(t.Uploaded, t.DBZip.Path) {
+		err := UploadFileToS3(t.Task.CreateS3Config(types.StorageClassStandard), context.TODO(), t.DBKey, t.DBZip.Path, t.DBZip.SHA256)
+		if err != nil {
+			return err
+		}
+		if err := t.markUploaded(t.DBZip.Path); err != nil {
+			return err
+		}
 	}
 	lg.Logs.Info("Task %s uploaded", t.Task.ID)
 	return nil
 }
 
+// DBUploaded reports whether the DB of the run was uploaded. It is not when
+// the run changed nothing.
+func (t *TaskUploader) DBUploaded() bool {
+	return t.DBZip != nil && slices.Contains(t.Uploaded, t.DBZip.Path)
+}
+
 func (t *TaskUploader) UploadAndDelete() error {
 	err := t.Upload()
 	if err != nil {
@@ -42,13 +123,13 @@ func (t *TaskUploader) UploadAndDelete() error {
 	}
 
 	lg.Logs.Info("Deleting temp files of task %s, files: %d", t.Task.ID, len(t.ArchivedFiles))
-	err = os.Remove(t.DBZipPath)
-	if err != nil {
+	err = os.Remove(t.DBZip.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 	for _, file := range t.ArchivedFiles {
-		err = os.Remove(file)
-		if err != nil {
+		err = os.Remove(file.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
 	}
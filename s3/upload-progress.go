@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// partBufferPool hands out a fixed number of part sized buffers. Callers
+// block on get until a buffer is returned, which bounds the memory used by a
+// multipart upload to count * size bytes.
+type partBufferPool struct {
+	buffers chan []byte
+	size    int64
+}
+
+func newPartBufferPool(count int, size int64) *partBufferPool {
+	pool := &partBufferPool{
+		buffers: make(chan []byte, count),
+		size:    size,
+	}
+	for range count {
+		pool.buffers <- nil
+	}
+	return pool
+}
+
+func (p *partBufferPool) get() []byte {
+	buf := <-p.buffers
+	if buf == nil {
+		// allocate lazily so small uploads don't pay for unused buffers
+		buf = make([]byte, p.size)
+	}
+	return buf
+}
+
+func (p *partBufferPool) put(buf []byte) {
+	p.buffers <- buf[:cap(buf)]
+}
+
+// uploadProgress aggregates the bytes sent by every in-flight part into a
+// single progress line.
+type uploadProgress struct {
+	key        string
+	totalSize  int64
+	totalParts int32
+	partsDone  atomic.Int32
+	sent       []atomic.Int64 // bytes sent per part, indexed by part number - 1
+	startedAt  time.Time
+}
+
+func newUploadProgress(key string, totalSize int64, totalParts int32) *uploadProgress {
+	return &uploadProgress{
+		key:        key,
+		totalSize:  totalSize,
+		totalParts: totalParts,
+		sent:       make([]atomic.Int64, totalParts),
+		startedAt:  time.Now(),
+	}
+}
+
+func (p *uploadProgress) reader(partNumber int32, data []byte) io.ReadSeeker {
+	p.sent[partNumber-1].Store(0)
+	return &progressReader{reader: bytes.NewReader(data), sent: &p.sent[partNumber-1]}
+}
+
+func (p *uploadProgress) partDone(partNumber int32, size int64) {
+	p.sent[partNumber-1].Store(size)
+	p.partsDone.Add(1)
+}
+
+func (p *uploadProgress) uploaded() int64 {
+	total := int64(0)
+	for i := range p.sent {
+		total += p.sent[i].Load()
+	}
+	return total
+}
+
+func (p *uploadProgress) print() {
+	uploaded := p.uploaded()
+	elapsed := time.Since(p.startedAt).Seconds()
+	speed := float64(0)
+	if elapsed > 0 {
+		speed = float64(uploaded) / 1024 / 1024 / elapsed
+	}
+	fmt.Printf("\r>>> Uploading (%s): %d/%d parts, %.2f%%, %.2f MB/s", p.key, p.partsDone.Load(), p.totalParts, float64(uploaded)*100/float64(p.totalSize), speed)
+}
+
+// start prints the progress line every second until the returned func is called.
+func (p *uploadProgress) start() func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-done:
+				p.print()
+				println("")
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// progressReader counts the bytes read from a part body. The SDK may rewind
+// the body to retry a request, so seeking resets the count to the new offset.
+type progressReader struct {
+	reader *bytes.Reader
+	sent   *atomic.Int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.sent.Add(int64(n))
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.reader.Seek(offset, whence)
+	if err == nil {
+		r.sent.Store(pos)
+	}
+	return pos, err
+}
@@ -0,0 +1,239 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	lg "s3-diff-archive/logger"
+	nTypes "s3-diff-archive/types"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// multipart uploads older than this that have no local state are considered
+// abandoned and aborted
+const staleUploadAge = 24 * time.Hour
+
+type uploadedPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// uploadState is persisted in the working dir while a multipart upload is in
+// progress so that a later run can resume it after a crash.
+type uploadState struct {
+	Bucket    string         `json:"bucket"`
+	Key       string         `json:"key"`
+	UploadID  string         `json:"upload_id"`
+	FilePath  string         `json:"file_path"`
+	FileSize  int64          `json:"file_size"`
+	FileMtime int64          `json:"file_mtime"`
+	PartSize  int64          `json:"part_size"`
+	Parts     []uploadedPart `json:"parts"`
+	Initiated time.Time      `json:"initiated"`
+
+	path string
+	mu   sync.Mutex
+}
+
+func uploadStatePath(stateDir, bucket, key string) string {
+	sum := sha1.Sum([]byte(bucket + "/" + key))
+	return filepath.Join(stateDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func readUploadState(statePath string) (*uploadState, error) {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid upload state %s: %w", statePath, err)
+	}
+	state.path = statePath
+	return &state, nil
+}
+
+// loadUploadState returns the saved state of an unfinished upload of key, or
+// nil when there is nothing to resume. A saved state belonging to a different
+// version of the file is aborted and discarded.
+func loadUploadState(ctx context.Context, client *s3.Client, cnfg *nTypes.S3Config, key string, fileInfo os.FileInfo, filePath string) *uploadState {
+	if cnfg.StateDir == "" {
+		return nil
+	}
+	state, err := readUploadState(uploadStatePath(cnfg.StateDir, cnfg.S3Bucket, key))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			lg.Logs.Warn("%s", err.Error())
+		}
+		return nil
+	}
+	if state.FilePath != filePath || state.FileSize != fileInfo.Size() || state.FileMtime != fileInfo.ModTime().UnixNano() {
+		lg.Logs.Warn("Source of unfinished upload %s changed, aborting upload %s", key, state.UploadID)
+		abortUpload(ctx, client, state.Bucket, state.Key, state.UploadID)
+		state.remove()
+		return nil
+	}
+	return state
+}
+
+func newUploadState(cnfg *nTypes.S3Config, key, uploadID, filePath string, fileInfo os.FileInfo, partSize int64) *uploadState {
+	state := &uploadState{
+		Bucket:    cnfg.S3Bucket,
+		Key:       key,
+		UploadID:  uploadID,
+		FilePath:  filePath,
+		FileSize:  fileInfo.Size(),
+		FileMtime: fileInfo.ModTime().UnixNano(),
+		PartSize:  partSize,
+		Parts:     []uploadedPart{},
+		Initiated: time.Now().UTC(),
+	}
+	if cnfg.StateDir != "" {
+		state.path = uploadStatePath(cnfg.StateDir, cnfg.S3Bucket, key)
+	}
+	return state
+}
+
+func (s *uploadState) addPart(partNumber int32, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Parts = append(s.Parts, uploadedPart{PartNumber: partNumber, ETag: etag})
+	s.saveLocked()
+}
+
+func (s *uploadState) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saveLocked()
+}
+
+func (s *uploadState) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		lg.Logs.Warn("Failed to save upload state: %s", err.Error())
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		lg.Logs.Warn("Failed to save upload state: %s", err.Error())
+		return
+	}
+	// write and rename so a crash never leaves a half written state file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		lg.Logs.Warn("Failed to save upload state: %s", err.Error())
+		return
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		lg.Logs.Warn("Failed to save upload state: %s", err.Error())
+	}
+}
+
+func (s *uploadState) remove() {
+	if s.path != "" {
+		_ = os.Remove(s.path)
+	}
+}
+
+// listUploadedParts returns the parts S3 already holds for an upload, keyed
+// by part number.
+func listUploadedParts(ctx context.Context, client *s3.Client, cnfg *nTypes.S3Config, key, uploadID string) (map[int32]types.Part, error) {
+	parts := map[int32]types.Part{}
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(cnfg.S3Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	applySSEToListParts(cnfg, input)
+	paginator := s3.NewListPartsPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = part
+		}
+	}
+	return parts, nil
+}
+
+func abortUpload(ctx context.Context, client *s3.Client, bucket, key, uploadID string) {
+	_, err := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		lg.Logs.Warn("Failed to abort multipart upload %s of %s: %s", uploadID, key, err.Error())
+	}
+}
+
+// AbortStaleUploads aborts multipart uploads under the task's base path that
+// can no longer be resumed: uploads whose local source zip is gone, and
+// uploads older than a day that no local state refers to.
+func AbortStaleUploads(cnfg *nTypes.S3Config, ctx context.Context) error {
+	s3Client, err := newClient(ctx, cnfg)
+	if err != nil {
+		return err
+	}
+
+	tracked := map[string]bool{}
+	if cnfg.StateDir != "" {
+		statePaths, _ := filepath.Glob(filepath.Join(cnfg.StateDir, "*.json"))
+		for _, statePath := range statePaths {
+			state, err := readUploadState(statePath)
+			if err != nil {
+				lg.Logs.Warn("%s", err.Error())
+				continue
+			}
+			if state.Bucket != cnfg.S3Bucket {
+				continue
+			}
+			if _, err := os.Stat(state.FilePath); err != nil {
+				lg.Logs.Warn("Source of unfinished upload %s is gone, aborting upload %s", state.Key, state.UploadID)
+				abortUpload(ctx, s3Client, state.Bucket, state.Key, state.UploadID)
+				state.remove()
+				continue
+			}
+			tracked[state.UploadID] = true
+		}
+	}
+
+	prefix := strings.TrimSuffix(cnfg.S3BasePath, "/") + "/"
+	paginator := s3.NewListMultipartUploadsPaginator(s3Client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(cnfg.S3Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range page.Uploads {
+			uploadID := aws.ToString(upload.UploadId)
+			if tracked[uploadID] {
+				continue
+			}
+			if upload.Initiated != nil && time.Since(*upload.Initiated) < staleUploadAge {
+				continue
+			}
+			lg.Logs.Warn("Aborting stale multipart upload %s of %s, initiated %s", uploadID, aws.ToString(upload.Key), aws.ToTime(upload.Initiated).Format(time.RFC3339))
+			abortUpload(ctx, s3Client, cnfg.S3Bucket, aws.ToString(upload.Key), uploadID)
+		}
+	}
+	return nil
+}
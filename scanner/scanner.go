@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"path"
+	"path/filepath"
 	"s3-diff-archive/types"
 	"s3-diff-archive/utils"
 
@@ -13,108 +13,203 @@ import (
 	badger "github.com/dgraph-io/badger/v4"
 )
 
+// scanState is what a scan remembers across dirs.
+type scanState struct {
+	root      utils.Root
+	hardlinks map[string]string // inode to the first path seen with it
+	visited   map[string]bool   // real paths of the dirs iterated, for followed symlinks
+	filter    *utils.Filter
+}
+
 func ScanTask(db *badger.DB, task *utils.TaskConfig) *ScannedResult {
 	result := &ScannedResult{
 		UpdatedFiles:   []*types.SFile{},
-		SkippedFiles:   []string{},
+		SkippedFiles:   []*SkippedFile{},
 		UnChangedFiles: []*types.SFile{},
+		MetaChanged:    []*types.SFile{},
 	}
 	lg.Logs.Info("Scanning task %s", task.ID)
 	lg.ScanLog.Info("Scanning task %s", task.ID)
-	if task.Dir == "" {
-		lg.ScanLog.Info("No dir specified for task %s", task.ID)
-		return result
-	}
-	exists := utils.IsPathExists(task.Dir)
-	if !exists {
-		lg.ScanLog.Error("Dir %s does not exist for task %s", task.Dir, task.ID)
-		lg.Logs.Error("Dir %s does not exist for task %s", task.Dir, task.ID)
-		return result
+	for _, root := range task.Roots() {
+		if root.Path == "" {
+			lg.ScanLog.Info("No dir specified for task %s", task.ID)
+			continue
+		}
+		exists := utils.IsPathExists(root.Path)
+		if !exists {
+			lg.ScanLog.Error("Dir %s does not exist for task %s", root.Path, task.ID)
+			lg.Logs.Error("Dir %s does not exist for task %s", root.Path, task.ID)
+			continue
+		}
+		// hardlinks are only kept within a dir, so each dir restores on its own
+		state := &scanState{root: root, hardlinks: map[string]string{}, visited: map[string]bool{}, filter: utils.NewFilter(task, root)}
+		iterator(db, task, result, state, root.Path)
 	}
-	iterator(db, task, result, task.Dir)
 	println("")
 	return result
 }
 
-func iterator(rdb *badger.DB, task *utils.TaskConfig, res *ScannedResult, dirPath string) {
+// iterator records the entries of a dir and its subdirs. It returns false
+// for a dir that was already scanned through another path.
+func iterator(rdb *badger.DB, task *utils.TaskConfig, res *ScannedResult, state *scanState, dirPath string) bool {
 	lg.ScanLog.Info("%s\t Iterating into dir: %s", task.ID, dirPath)
 
+	if realPath, err := filepath.EvalSymlinks(dirPath); err == nil {
+		if state.visited[realPath] {
+			lg.ScanLog.Info("%s\t Skipping dir %s, it was already scanned through another path", task.ID, dirPath)
+			return false
+		}
+		state.visited[realPath] = true
+	}
+
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
 		panic(err)
 	}
 
 	for _, file := range files {
-		if file.IsDir() {
-			iterator(rdb, task, res, dirPath+"/"+file.Name())
-		} else {
-
-			// change to relative path to task.Dir
-			relativeFilePath := utils.RelativePath(dirPath+"/"+file.Name(), task.Dir)
-
-			// ignore any excluded files
-			skip := false
-			for _, patterm := range task.Excludes {
-				if utils.MatchPattern(patterm, relativeFilePath) {
-					// lg.Logs.Warn("Skipping file %s due to exclude pattern %s", path.Join(task.Dir, relativeFilePath), patterm)
-					lg.ScanLog.Info("Slipped file: %s, due to exclude pattern %s", path.Join(task.Dir, relativeFilePath), patterm)
-					skip = true
-					break
-				}
+		filePath := dirPath + "/" + file.Name()
+		// filters take the path relative to the dir, everything else the
+		// path it is archived under
+		rootRelativePath := utils.RelativePath(filePath, state.root.Path)
+		relativeFilePath := state.root.ArchivePath(rootRelativePath)
+
+		stats, err := os.Lstat(filePath)
+		if err != nil {
+			panic(err)
+		}
+		isSymlink := stats.Mode()&os.ModeSymlink != 0
+		followed := false
+		if isSymlink && task.Symlinks == utils.SymlinksSkip {
+			res.skip(&SkippedFile{RelativePath: relativeFilePath, Rule: "symlinks", Reason: "symlinks is skip"})
+			continue
+		}
+		if isSymlink && task.Symlinks == utils.SymlinksFollow {
+			stats, err = os.Stat(filePath)
+			if err != nil {
+				res.skip(&SkippedFile{RelativePath: relativeFilePath, Rule: "symlinks", Reason: "dangling, " + err.Error()})
+				continue
 			}
-			if skip {
-				res.SkippedFiles = append(res.SkippedFiles, relativeFilePath)
+			isSymlink = false
+			followed = true
+		}
+
+		if stats.IsDir() {
+			if rule, reason := state.filter.SkipDir(rootRelativePath); rule != "" {
+				res.skip(&SkippedFile{RelativePath: relativeFilePath, Rule: rule, Reason: reason, IsDir: true})
 				continue
 			}
+			recorded := res.recorded()
+			iterated := iterator(rdb, task, res, state, filePath)
+			// an empty dir is filtered like a file, by its path
+			if rule, _ := state.filter.SkipPath(rootRelativePath); iterated && task.EmptyDirs == utils.EmptyDirsStore && res.recorded() == recorded && rule == "" {
+				sfile := &types.SFile{RelativePath: relativeFilePath, Name: stats.Name(), Mtime: stats.ModTime().Unix(), Type: types.FileTypeDir}
+				sfile.Meta, err = utils.ReadFileMeta(filePath, stats)
+				if err != nil {
+					panic(err)
+				}
+				record(rdb, task, res, sfile)
+			}
+			continue
+		}
 
-			stats, err := os.Stat(dirPath + "/" + file.Name())
+		// before the metadata, hardlinks and the DB are looked at
+		if rule, reason := state.filter.SkipFile(rootRelativePath, stats); rule != "" {
+			res.skip(&SkippedFile{RelativePath: relativeFilePath, Rule: rule, Reason: reason, Size: stats.Size()})
+			continue
+		}
+
+		sfile := &types.SFile{RelativePath: relativeFilePath, Name: stats.Name(), Size: stats.Size(), Mtime: stats.ModTime().Unix()}
+		switch {
+		case isSymlink:
+			sfile.Type = types.FileTypeSymlink
+			sfile.Target, err = os.Readlink(filePath)
 			if err != nil {
 				panic(err)
 			}
-
-			file, fileUpdated := hasFileUpdated(rdb, relativeFilePath, &stats)
-			lg.ScanLog.Info("%s\t%s, File Updated: %t, Size: %d", task.ID, relativeFilePath, fileUpdated, stats.Size())
-
-			if fileUpdated {
-				res.UpdatedFiles = append(res.UpdatedFiles, file)
-			} else {
-				res.UnChangedFiles = append(res.UnChangedFiles, file)
+		case !stats.Mode().IsRegular():
+			if task.SpecialFiles != utils.SpecialFilesRecord {
+				res.skip(&SkippedFile{RelativePath: relativeFilePath, Rule: "special_files", Reason: "not a regular file, special_files is skip"})
+				continue
+			}
+			sfile.Type = utils.SpecialFileType(stats)
+			sfile.Size = 0
+			sfile.Device = utils.DeviceNumber(stats)
+			sfile.Meta, err = utils.ReadFileMeta(filePath, stats)
+			if err != nil {
+				panic(err)
+			}
+		default:
+			// a followed symlink is archived as a copy, even of a hardlinked file
+			if inode, ok := utils.HardlinkID(stats); ok && !followed && task.Hardlinks == utils.HardlinksStore {
+				if first, seen := state.hardlinks[inode]; seen {
+					sfile.Type = types.FileTypeHardlink
+					sfile.Target = first
+				} else {
+					state.hardlinks[inode] = relativeFilePath
+				}
+			}
+			sfile.Meta, err = utils.ReadFileMeta(filePath, stats)
+			if err != nil {
+				panic(err)
 			}
 		}
-		fmt.Printf("\r>>> Scanned: %d files, Change Detected: %d files, Skipped: %d files", len(res.UpdatedFiles)+len(res.UnChangedFiles)+len(res.SkippedFiles), len(res.UpdatedFiles), len(res.SkippedFiles))
+		record(rdb, task, res, sfile)
+	}
+	return true
+}
+
+func record(rdb *badger.DB, task *utils.TaskConfig, res *ScannedResult, file *types.SFile) {
+	fileUpdated, metaUpdated := hasFileUpdated(rdb, file)
+	lg.ScanLog.Info("%s\t%s, File Updated: %t, Metadata Updated: %t, Size: %d", task.ID, file.RelativePath, fileUpdated, metaUpdated, file.Size)
+
+	if fileUpdated {
+		res.UpdatedFiles = append(res.UpdatedFiles, file)
+	} else if metaUpdated {
+		res.MetaChanged = append(res.MetaChanged, file)
+	} else {
+		res.UnChangedFiles = append(res.UnChangedFiles, file)
+	}
+	fmt.Printf("\r>>> Scanned: %d files, Change Detected: %d files, Skipped: %d files", res.TotalScanned(), len(res.UpdatedFiles)+len(res.MetaChanged), len(res.SkippedFiles))
+}
+
+// hasFileUpdated compares a scanned entry with its entry in the DB. It
+// reports whether the entry changed, by size, mtime, name, type, link target
+// or device, or was zipped while it changed, and whether only its metadata
+// changed. Unchanged files keep the zip their content was archived to.
+func hasFileUpdated(rdb *badger.DB, newSfile *types.SFile) (bool, bool) {
+	file, err := LookupSfile(rdb, newSfile.RelativePath)
+	if err != nil {
+		return true, false
+	}
+
+	if newSfile.Size != file.Size || newSfile.Mtime != file.Mtime || newSfile.Name != file.Name ||
+		newSfile.Type != file.Type || newSfile.Target != file.Target || newSfile.Device != file.Device || file.Inconsistent {
+		return true, false
 	}
+
+	newSfile.Archive = file.Archive
+	newSfile.Hash = file.Hash
+	newSfile.Holes = file.Holes
+	// entries archived before metadata was recorded have none, their
+	// metadata is recorded without counting as a change
+	return false, file.Meta != nil && !newSfile.Meta.Equal(file.Meta)
 }
 
-func hasFileUpdated(rdb *badger.DB, relativePath string, statsPointer *os.FileInfo) (*types.SFile, bool) {
-	stats := *statsPointer
+// LookupSfile returns the entry of a path in the DB.
+func LookupSfile(rdb *badger.DB, relativePath string) (*types.SFile, error) {
 	var file types.SFile
 	err := rdb.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(relativePath))
 		if err != nil {
-			// println("___", err.Error())
 			return err
 		}
-		err = item.Value(func(val []byte) error {
-			err := json.Unmarshal(val, &file)
-			if err != nil {
-				return err
-			}
-			return nil
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &file)
 		})
-		if err != nil {
-			return err
-		}
-		return nil
 	})
-
-	newSfile := &types.SFile{RelativePath: relativePath, Name: stats.Name(), Size: stats.Size(), Mtime: stats.ModTime().Unix()}
 	if err != nil {
-		return newSfile, true
+		return nil, err
 	}
-
-	if stats.Size() != file.Size || stats.ModTime().Unix() != file.Mtime || stats.Name() != file.Name {
-		return newSfile, true
-	}
-
-	return newSfile, false
+	return &file, nil
 }
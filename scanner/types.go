@@ -2,13 +2,33 @@ package scanner
 
 import (
 	"fmt"
+	lg "s3-diff-archive/logger"
 	"s3-diff-archive/types"
+	"sort"
 )
 
 type ScannedResult struct {
 	UpdatedFiles   []*types.SFile
-	SkippedFiles   []string
+	SkippedFiles   []*SkippedFile
 	UnChangedFiles []*types.SFile
+	MetaChanged    []*types.SFile // files whose permissions, owner or xattrs changed but not their content
+}
+
+// SkippedFile is an entry the scan left out, with the rule that skipped it.
+type SkippedFile struct {
+	RelativePath string
+	Rule         string // one of the utils.Rule constants, or the task setting that skipped it
+	Reason       string
+	Size         int64 // of a file, dirs are skipped without being searched
+	IsDir        bool
+}
+
+// SkippedByRule is what a rule left out of a scan.
+type SkippedByRule struct {
+	Rule  string
+	Files int
+	Dirs  int
+	Bytes int64
 }
 
 type TaskScanSummary struct {
@@ -17,10 +37,46 @@ type TaskScanSummary struct {
 	UpdatedFiles   int
 	SkippedFiles   int
 	UnChangedFiles int
+	MetaChanged    int
 }
 
 func (sr *ScannedResult) TotalScanned() int {
-	return len(sr.UpdatedFiles) + len(sr.SkippedFiles) + len(sr.UnChangedFiles)
+	return len(sr.UpdatedFiles) + len(sr.SkippedFiles) + len(sr.UnChangedFiles) + len(sr.MetaChanged)
+}
+
+func (sr *ScannedResult) skip(skipped *SkippedFile) {
+	lg.ScanLog.Info("Skipped %s by %s: %s", skipped.RelativePath, skipped.Rule, skipped.Reason)
+	sr.SkippedFiles = append(sr.SkippedFiles, skipped)
+}
+
+// SkippedByRule totals the skipped entries by the rule that skipped them,
+// sorted by bytes.
+func (sr *ScannedResult) SkippedByRule() []*SkippedByRule {
+	byRule := map[string]*SkippedByRule{}
+	totals := []*SkippedByRule{}
+	for _, skipped := range sr.SkippedFiles {
+		total := byRule[skipped.Rule]
+		if total == nil {
+			total = &SkippedByRule{Rule: skipped.Rule}
+			byRule[skipped.Rule] = total
+			totals = append(totals, total)
+		}
+		if skipped.IsDir {
+			total.Dirs++
+		} else {
+			total.Files++
+		}
+		total.Bytes += skipped.Size
+	}
+	sort.SliceStable(totals, func(i, j int) bool {
+		return totals[i].Bytes > totals[j].Bytes
+	})
+	return totals
+}
+
+// recorded is the number of entries the scan has recorded so far.
+func (sr *ScannedResult) recorded() int {
+	return len(sr.UpdatedFiles) + len(sr.UnChangedFiles) + len(sr.MetaChanged)
 }
 
 func (sr *ScannedResult) Summary(taskId string) *TaskScanSummary {
@@ -30,10 +86,11 @@ func (sr *ScannedResult) Summary(taskId string) *TaskScanSummary {
 		UpdatedFiles:   len(sr.UpdatedFiles),
 		SkippedFiles:   len(sr.SkippedFiles),
 		UnChangedFiles: len(sr.UnChangedFiles),
+		MetaChanged:    len(sr.MetaChanged),
 	}
 }
 
 func (ts *TaskScanSummary) Message() string {
-	return fmt.Sprintf("Task: %s, Total: %d, Updated: %d, Skipped: %d, Unchanged: %d",
-		ts.TaskID, ts.TotalScanned, ts.UpdatedFiles, ts.SkippedFiles, ts.UnChangedFiles)
+	return fmt.Sprintf("Task: %s, Total: %d, Updated: %d, Metadata changed: %d, Skipped: %d, Unchanged: %d",
+		ts.TaskID, ts.TotalScanned, ts.UpdatedFiles, ts.MetaChanged, ts.SkippedFiles, ts.UnChangedFiles)
 }
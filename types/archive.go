@@ -0,0 +1,19 @@
+package types
+
+// Archive is a zip created by a run, along with the SHA-256 checksum computed
+// while it was written.
+type Archive struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex encoded
+	Files  int    `json:"files"`  // number of entries
+	Bytes  int64  `json:"bytes"`  // uncompressed size of the entries
+}
+
+func ArchivesToPaths(archives []*Archive) []string {
+	var paths []string
+	for _, archive := range archives {
+		paths = append(paths, archive.Path)
+	}
+	return paths
+}
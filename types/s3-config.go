@@ -11,4 +11,13 @@ type S3Config struct {
 	S3Bucket        string
 	S3BasePath      string
 	StorageClass    types.StorageClass
+	PartSize        int64  // multipart part size in bytes
+	Concurrency     int    // number of parts uploaded in parallel
+	StateDir        string // where unfinished multipart uploads are tracked
+	SSE             types.ServerSideEncryption
+	SSEKMSKeyID     string
+	SSECustomerKey  []byte // raw 256-bit key for SSE-C
+	ObjectLockMode  types.ObjectLockMode
+	ObjectLockDays  int
+	LegalHold       bool
 }
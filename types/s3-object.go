@@ -0,0 +1,16 @@
+package types
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Object describes a stored object. Key is relative to the S3 base path it
+// was listed under.
+type S3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	StorageClass types.ObjectStorageClass
+}
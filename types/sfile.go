@@ -1,10 +1,89 @@
 package types
 
+import (
+	"bytes"
+	"maps"
+)
+
 type SFile struct {
-	RelativePath string `json:"path"`
-	Name         string `json:"name"`
-	Size         int64  `json:"size"`
-	Mtime        int64  `json:"mtime"`
+	RelativePath string    `json:"path"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Mtime        int64     `json:"mtime"`
+	Archive      string    `json:"archive,omitempty"`      // zip holding the content, empty for files archived before it was recorded
+	Hash         string    `json:"sha256,omitempty"`       // SHA-256 of the content, computed while zipping
+	Meta         *FileMeta `json:"meta,omitempty"`         // nil for files archived before it was recorded, and for symlinks
+	Type         string    `json:"type,omitempty"`         // one of the FileType constants
+	Target       string    `json:"target,omitempty"`       // what a symlink points to, the path of the file a hardlink shares its content with, or the first part of a volume
+	Holes        []Extent  `json:"holes,omitempty"`        // holes of a sparse file, its zip entry holds the data between them back to back
+	Device       uint64    `json:"device,omitempty"`       // device number of a device file
+	Inconsistent bool      `json:"inconsistent,omitempty"` // changed while it was zipped, so the next scan archives it again
+	Volume       int       `json:"volume,omitempty"`       // number of a part of a command output split across zips, from 2, restored appended to its first part
+}
+
+// Extent is a region of a file.
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// DataExtents returns the regions of a file of size bytes that are not in
+// holes, which must be sorted and must not overlap.
+func DataExtents(holes []Extent, size int64) []Extent {
+	data := []Extent{}
+	offset := int64(0)
+	for _, hole := range holes {
+		if hole.Offset > offset {
+			data = append(data, Extent{Offset: offset, Length: hole.Offset - offset})
+		}
+		offset = hole.Offset + hole.Length
+	}
+	if offset < size {
+		data = append(data, Extent{Offset: offset, Length: size - offset})
+	}
+	return data
+}
+
+// Entries other than regular files have no content in a zip.
+const (
+	FileTypeRegular  = ""
+	FileTypeDir      = "dir" // an empty dir
+	FileTypeSymlink  = "symlink"
+	FileTypeHardlink = "hardlink"
+	FileTypeFIFO     = "fifo"
+	FileTypeSocket   = "socket"
+	FileTypeDevice   = "device"      // block device
+	FileTypeChar     = "char-device" // character device
+)
+
+// HasContent reports whether the content of the entry is stored in a zip.
+func (f *SFile) HasContent() bool {
+	return f.Type == FileTypeRegular
+}
+
+// FileMeta is the metadata of a file that is restored along with its content.
+type FileMeta struct {
+	Mode   uint32            `json:"mode"` // permission bits along with setuid, setgid and sticky, as an os.FileMode
+	UID    int               `json:"uid"`
+	GID    int               `json:"gid"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"` // extended attributes, POSIX ACLs included
+}
+
+func (m *FileMeta) Equal(other *FileMeta) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.Mode == other.Mode && m.UID == other.UID && m.GID == other.GID &&
+		maps.EqualFunc(m.Xattrs, other.Xattrs, bytes.Equal)
+}
+
+// StoredSize is the number of bytes of the file held in its zip entry.
+func (f *SFile) StoredSize() int64 {
+	size := f.Size
+	for _, hole := range f.Holes {
+		size -= hole.Length
+	}
+	return size
 }
 
 func SfilesToNames(sfiles []*SFile) []string {
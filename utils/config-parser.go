@@ -1,9 +1,14 @@
 package utils
 
 import (
+	"encoding/base64"
 	"fmt"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,11 +30,14 @@ type Secrets struct {
 
 type BaseConfig struct {
 	Secrets
-	NotifyScript string `yaml:"notify_script"`
-	MaxZipSize   int64  `yaml:"max_zip_size"` // in MB
-	S3BasePath   string `yaml:"s3_base_path"`
-	WorkingDir   string `yaml:"working_dir"`
-	LogsDir      string `yaml:"logs_dir"`
+	NotifyScript      string `yaml:"notify_script"`
+	MaxZipSize        int64  `yaml:"max_zip_size"` // in MB
+	S3BasePath        string `yaml:"s3_base_path"`
+	WorkingDir        string `yaml:"working_dir"`
+	LogsDir           string `yaml:"logs_dir"`
+	UploadPartSize    int64  `yaml:"upload_part_size"` // in MB
+	UploadConcurrency int    `yaml:"upload_concurrency"`
+	LockTTLMinutes    int    `yaml:"lock_ttl"` // in minutes
 }
 
 type Config struct {
@@ -38,13 +46,119 @@ type Config struct {
 }
 
 type Task struct {
-	ID                 string   `yaml:"id"`
-	Dir                string   `yaml:"dir"`
-	Excludes           []string `yaml:"exclude"`
-	StorageClassString string   `yaml:"storage_class"`
-	UseChecksum        bool     `yaml:"use_checksum"`
-	Password           string   `yaml:"encryption_key"`
-	StorageClass       types.StorageClass
+	ID                   string     `yaml:"id"`
+	Tags                 []string   `yaml:"tags"` // for picking tasks with -tag
+	Dir                  string     `yaml:"dir"`
+	Dirs                 []Root     `yaml:"dirs"`      // several source dirs instead of dir, each archived under its prefix
+	Source               string     `yaml:"source"`    // dir | command, default dir
+	Command              string     `yaml:"command"`   // for command, its output is archived
+	FileName             string     `yaml:"file_name"` // for command, the path the output is archived under, default the task id
+	Excludes             []string   `yaml:"exclude"`
+	Includes             []string   `yaml:"include"`        // when set, only files matching one of them are archived
+	MaxFileSizeString    string     `yaml:"max_file_size"`  // larger files are skipped, e.g. 2GB
+	MinFileSizeString    string     `yaml:"min_file_size"`  // smaller files are skipped
+	OlderThanString      string     `yaml:"older_than"`     // only files last modified longer ago than this are archived, e.g. 30d
+	NewerThanString      string     `yaml:"newer_than"`     // only files modified within this are archived
+	ExcludeCaches        bool       `yaml:"exclude_caches"` // skip dirs holding a CACHEDIR.TAG
+	StorageClassString   string     `yaml:"storage_class"`
+	UseChecksum          bool       `yaml:"use_checksum"`
+	Password             string     `yaml:"encryption_key"`
+	SSE                  string     `yaml:"sse"`              // AES256 | aws:kms | customer
+	SSEKMSKeyID          string     `yaml:"sse_kms_key_id"`   // for aws:kms, default is the AWS managed key
+	SSECustomerKeySrc    string     `yaml:"sse_customer_key"` // for customer, env:VAR or file:path
+	ObjectLock           ObjectLock `yaml:"object_lock"`
+	DBHistory            int        `yaml:"db_history"` // DB generations to keep, 0 keeps all
+	Retention            Retention  `yaml:"retention"`
+	Symlinks             string     `yaml:"symlinks"`       // store | follow | skip, default store
+	Hardlinks            string     `yaml:"hardlinks"`      // store | copy, default store
+	EmptyDirs            string     `yaml:"empty_dirs"`     // store | skip, default store
+	SpecialFiles         string     `yaml:"special_files"`  // skip | record, default skip
+	ChangeRetriesSetting *int       `yaml:"change_retries"` // times a file that changed while it was zipped is zipped again, default 3, 0 never
+	PreHook              string     `yaml:"pre_hook"`       // run before the task is archived, the task is skipped if it fails
+	PostHook             string     `yaml:"post_hook"`      // run after the task is archived, whether it succeeded or not
+	OnErrorHook          string     `yaml:"on_error_hook"`  // run when a hook or the archive fails
+	HookTimeoutMinutes   int        `yaml:"hook_timeout"`   // in minutes, default 60
+	StorageClass         types.StorageClass
+	SSECustomerKey       []byte        `yaml:"-"`
+	MaxFileSize          int64         `yaml:"-"` // in bytes, 0 for no limit
+	MinFileSize          int64         `yaml:"-"`
+	OlderThan            time.Duration `yaml:"-"`
+	NewerThan            time.Duration `yaml:"-"`
+	ChangeRetries        int           `yaml:"-"`
+}
+
+// Root is a source dir of a task and the prefix its files are archived
+// under, so the files of several dirs share one DB.
+type Root struct {
+	Path   string `yaml:"path"`
+	Prefix string `yaml:"prefix"` // default the name of the dir
+}
+
+// String is the dir of the root, after its prefix when it has one.
+func (r Root) String() string {
+	if r.Prefix == "" {
+		return r.Path
+	}
+	return r.Prefix + "=" + r.Path
+}
+
+// ArchivePath is the path a file of the root is archived under, from its
+// path relative to the root.
+func (r Root) ArchivePath(relativePath string) string {
+	if r.Prefix == "" {
+		return relativePath
+	}
+	return r.Prefix + "/" + relativePath
+}
+
+// Contains reports whether a file is archived under the prefix of the root,
+// and returns its path relative to the root.
+func (r Root) Contains(archivePath string) (string, bool) {
+	if r.Prefix == "" {
+		return archivePath, true
+	}
+	return strings.CutPrefix(archivePath, r.Prefix+"/")
+}
+
+// ObjectLock sets S3 Object Lock (WORM) retention on every uploaded object.
+// The bucket must have been created with Object Lock enabled.
+type ObjectLock struct {
+	Mode       string `yaml:"mode"`        // GOVERNANCE | COMPLIANCE
+	RetainDays int    `yaml:"retain_days"` // retain-until is upload time + days
+	LegalHold  bool   `yaml:"legal_hold"`
+}
+
+func (o ObjectLock) Enabled() bool {
+	return o.Mode != "" || o.LegalHold
+}
+
+// Retention is the grandfather-father-son policy applied by prune. A run is
+// kept if any rule keeps it; every rule counts back from the latest run.
+type Retention struct {
+	KeepLast    int `yaml:"keep_last"`    // most recent runs
+	KeepDaily   int `yaml:"keep_daily"`   // last run of each of the most recent days
+	KeepWeekly  int `yaml:"keep_weekly"`  // last run of each of the most recent ISO weeks
+	KeepMonthly int `yaml:"keep_monthly"` // last run of each of the most recent months
+	KeepYearly  int `yaml:"keep_yearly"`  // last run of each of the most recent years
+}
+
+const (
+	SymlinksStore  = "store"  // archive the link itself
+	SymlinksFollow = "follow" // archive what it points to
+	SymlinksSkip   = "skip"
+	HardlinksStore = "store" // archive the content once and restore the other paths as links to it
+	HardlinksCopy  = "copy"  // archive every path as a file of its own
+	EmptyDirsStore = "store"
+	EmptyDirsSkip  = "skip"
+	// FIFOs, sockets and devices have no content to archive
+	SpecialFilesSkip   = "skip"
+	SpecialFilesRecord = "record" // record them in the DB and recreate them on restore
+	SourceDir          = "dir"
+	SourceCommand      = "command" // archive what a command writes to stdout as a file
+)
+
+func (r Retention) Enabled() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 || r.KeepMonthly > 0 || r.KeepYearly > 0
 }
 
 type TaskConfig struct {
@@ -61,6 +175,38 @@ func (c *Config) GetTask(taskId string) (*TaskConfig, error) {
 	return nil, fmt.Errorf("task not found")
 }
 
+// SelectTasks keeps the tasks named by ids or having one of tags, or every
+// task when both are empty, minus the tasks named by excluded. Naming a task
+// that does not exist, or selecting no task, is an error.
+func (c *Config) SelectTasks(ids, excluded, tags []string) error {
+	known := map[string]bool{}
+	for _, task := range c.Tasks {
+		known[task.ID] = true
+	}
+	for _, id := range append(append([]string{}, ids...), excluded...) {
+		if !known[id] {
+			return fmt.Errorf("task %s not found", id)
+		}
+	}
+
+	selected := []Task{}
+	for _, task := range c.Tasks {
+		picked := len(ids) == 0 && len(tags) == 0
+		picked = picked || slices.Contains(ids, task.ID)
+		for _, tag := range tags {
+			picked = picked || slices.Contains(task.Tags, tag)
+		}
+		if picked && !slices.Contains(excluded, task.ID) {
+			selected = append(selected, task)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no task matches the selection")
+	}
+	c.Tasks = selected
+	return nil
+}
+
 func getSecretsFromEnv(envPath string) Secrets {
 	err := godotenv.Load(envPath)
 	if err != nil {
@@ -131,6 +277,27 @@ func (c *Config) Validate() {
 		Err("Max zip size must be greater than 5MB")
 	}
 
+	if c.UploadPartSize == 0 {
+		c.UploadPartSize = 90
+	}
+	if c.UploadPartSize < 5 || c.UploadPartSize > 5*1024 {
+		Err("Upload part size must be between 5MB and 5120MB")
+	}
+
+	if c.UploadConcurrency == 0 {
+		c.UploadConcurrency = 4
+	}
+	if c.UploadConcurrency < 0 {
+		Err("Upload concurrency must be greater than 0")
+	}
+
+	if c.LockTTLMinutes == 0 {
+		c.LockTTLMinutes = 10
+	}
+	if c.LockTTLMinutes < 1 {
+		Err("Lock ttl must be at least 1 minute")
+	}
+
 	for i := range c.Tasks {
 		c.Tasks[i].validate()
 	}
@@ -138,7 +305,31 @@ func (c *Config) Validate() {
 }
 func (t *Task) validate() {
 	required(t.ID, "Task id")
-	required(t.Dir, fmt.Sprintf("Task - %s base dir", t.ID))
+	switch t.Source {
+	case "":
+		t.Source = SourceDir
+	case SourceDir, SourceCommand:
+	default:
+		Err(fmt.Sprintf("Invalid source: %s. Supported values: dir, command", t.Source))
+	}
+	if t.Source == SourceCommand {
+		// the dir is optional, restores go there by default
+		required(t.Command, fmt.Sprintf("Task - %s command", t.ID))
+		if len(t.Dirs) > 0 {
+			Err(fmt.Sprintf("Task - %s dirs cannot be used with source: command", t.ID))
+		}
+		if t.FileName == "" {
+			t.FileName = t.ID
+		}
+		t.FileName = path.Clean(t.FileName)
+		if path.IsAbs(t.FileName) || t.FileName == ".." || strings.HasPrefix(t.FileName, "../") {
+			Err(fmt.Sprintf("Task - %s file_name must be a relative path inside the task", t.ID))
+		}
+	} else if len(t.Dirs) > 0 {
+		t.validateDirs()
+	} else {
+		required(t.Dir, fmt.Sprintf("Task - %s base dir", t.ID))
+	}
 	if t.Excludes == nil {
 		t.Excludes = []string{}
 	}
@@ -147,6 +338,31 @@ func (t *Task) validate() {
 			Err("Task Exclude Regex cannot be empty")
 		}
 	}
+	for _, pattern := range t.Includes {
+		if pattern == "" {
+			Err(fmt.Sprintf("Task - %s include pattern cannot be empty", t.ID))
+		}
+	}
+
+	var err error
+	if t.MaxFileSize, err = parseSize(t.MaxFileSizeString); err != nil {
+		Err(fmt.Sprintf("Task - %s invalid max_file_size: %s", t.ID, err.Error()))
+	}
+	if t.MinFileSize, err = parseSize(t.MinFileSizeString); err != nil {
+		Err(fmt.Sprintf("Task - %s invalid min_file_size: %s", t.ID, err.Error()))
+	}
+	if t.MaxFileSize > 0 && t.MinFileSize > t.MaxFileSize {
+		Err(fmt.Sprintf("Task - %s min_file_size is larger than max_file_size", t.ID))
+	}
+	if t.OlderThan, err = parseAge(t.OlderThanString); err != nil {
+		Err(fmt.Sprintf("Task - %s invalid older_than: %s", t.ID, err.Error()))
+	}
+	if t.NewerThan, err = parseAge(t.NewerThanString); err != nil {
+		Err(fmt.Sprintf("Task - %s invalid newer_than: %s", t.ID, err.Error()))
+	}
+	if t.NewerThan > 0 && t.OlderThan >= t.NewerThan {
+		Err(fmt.Sprintf("Task - %s older_than must be less than newer_than, no file can match both", t.ID))
+	}
 
 	if t.StorageClassString == "" {
 		// println("Empty storage class")
@@ -167,6 +383,219 @@ func (t *Task) validate() {
 		}
 	}
 
+	switch t.SSE {
+	case "", string(types.ServerSideEncryptionAes256):
+	case string(types.ServerSideEncryptionAwsKms):
+	case sseCustomer:
+		required(t.SSECustomerKeySrc, fmt.Sprintf("Task - %s sse_customer_key", t.ID))
+		key, err := readSSECustomerKey(t.SSECustomerKeySrc)
+		if err != nil {
+			Err(fmt.Sprintf("Task - %s invalid sse_customer_key: %s", t.ID, err.Error()))
+		}
+		t.SSECustomerKey = key
+	default:
+		Err(fmt.Sprintf("Invalid sse: %s. Supported values: AES256, aws:kms, customer", t.SSE))
+	}
+	if t.SSEKMSKeyID != "" && t.SSE != string(types.ServerSideEncryptionAwsKms) {
+		Err(fmt.Sprintf("Task - %s sse_kms_key_id requires sse: aws:kms", t.ID))
+	}
+
+	if t.DBHistory < 0 {
+		Err(fmt.Sprintf("Task - %s db_history cannot be negative", t.ID))
+	}
+
+	if t.Retention.KeepLast < 0 || t.Retention.KeepDaily < 0 || t.Retention.KeepWeekly < 0 || t.Retention.KeepMonthly < 0 || t.Retention.KeepYearly < 0 {
+		Err(fmt.Sprintf("Task - %s retention counts cannot be negative", t.ID))
+	}
+
+	switch t.Symlinks {
+	case "":
+		t.Symlinks = SymlinksStore
+	case SymlinksStore, SymlinksFollow, SymlinksSkip:
+	default:
+		Err(fmt.Sprintf("Invalid symlinks: %s. Supported values: store, follow, skip", t.Symlinks))
+	}
+	switch t.Hardlinks {
+	case "":
+		t.Hardlinks = HardlinksStore
+	case HardlinksStore, HardlinksCopy:
+	default:
+		Err(fmt.Sprintf("Invalid hardlinks: %s. Supported values: store, copy", t.Hardlinks))
+	}
+	switch t.EmptyDirs {
+	case "":
+		t.EmptyDirs = EmptyDirsStore
+	case EmptyDirsStore, EmptyDirsSkip:
+	default:
+		Err(fmt.Sprintf("Invalid empty_dirs: %s. Supported values: store, skip", t.EmptyDirs))
+	}
+
+	if t.HookTimeoutMinutes == 0 {
+		t.HookTimeoutMinutes = 60
+	}
+	if t.HookTimeoutMinutes < 0 {
+		Err(fmt.Sprintf("Task - %s hook_timeout cannot be negative", t.ID))
+	}
+
+	// unlike the other counts, 0 is a setting, it turns retries off
+	t.ChangeRetries = 3
+	if t.ChangeRetriesSetting != nil {
+		t.ChangeRetries = *t.ChangeRetriesSetting
+	}
+	if t.ChangeRetries < 0 {
+		Err(fmt.Sprintf("Task - %s change_retries cannot be negative", t.ID))
+	}
+
+	switch t.SpecialFiles {
+	case "":
+		t.SpecialFiles = SpecialFilesSkip
+	case SpecialFilesSkip, SpecialFilesRecord:
+	default:
+		Err(fmt.Sprintf("Invalid special_files: %s. Supported values: skip, record", t.SpecialFiles))
+	}
+
+	switch types.ObjectLockMode(t.ObjectLock.Mode) {
+	case "":
+		if t.ObjectLock.RetainDays != 0 {
+			Err(fmt.Sprintf("Task - %s object_lock retain_days requires a mode", t.ID))
+		}
+	case types.ObjectLockModeGovernance, types.ObjectLockModeCompliance:
+		if t.ObjectLock.RetainDays <= 0 {
+			Err(fmt.Sprintf("Task - %s object_lock retain_days must be greater than 0", t.ID))
+		}
+	default:
+		Err(fmt.Sprintf("Invalid object_lock mode: %s. Supported modes: GOVERNANCE, COMPLIANCE", t.ObjectLock.Mode))
+	}
+
+}
+
+// validateDirs checks the source dirs of a task and defaults their prefixes.
+// Prefixes must not overlap, so every archived path belongs to one dir.
+func (t *Task) validateDirs() {
+	if t.Dir != "" {
+		Err(fmt.Sprintf("Task - %s has both dir and dirs, use one of them", t.ID))
+	}
+	for i := range t.Dirs {
+		root := &t.Dirs[i]
+		required(root.Path, fmt.Sprintf("Task - %s dirs path", t.ID))
+		if root.Prefix == "" {
+			root.Prefix = filepath.Base(filepath.Clean(root.Path))
+		}
+		root.Prefix = path.Clean(strings.Trim(root.Prefix, "/"))
+		if root.Prefix == "." || root.Prefix == ".." || strings.HasPrefix(root.Prefix, "../") {
+			Err(fmt.Sprintf("Task - %s invalid prefix %s for %s", t.ID, root.Prefix, root.Path))
+		}
+	}
+	for i, root := range t.Dirs {
+		for _, other := range t.Dirs[i+1:] {
+			if root.Prefix == other.Prefix || strings.HasPrefix(root.Prefix+"/", other.Prefix+"/") || strings.HasPrefix(other.Prefix+"/", root.Prefix+"/") {
+				Err(fmt.Sprintf("Task - %s prefixes of %s and %s overlap, set a prefix for them", t.ID, root.Path, other.Path))
+			}
+			if isWithin(root.Path, other.Path) || isWithin(other.Path, root.Path) {
+				Err(fmt.Sprintf("Task - %s dirs %s and %s are inside one another", t.ID, root.Path, other.Path))
+			}
+		}
+	}
+}
+
+func isWithin(dir, parent string) bool {
+	rel, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(dir))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+const sseCustomer = "customer"
+
+// parseSize parses a size like 512KB or 2GB, in powers of 1024. A plain
+// number is in bytes and an empty string is 0.
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.bytes
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(size >= 0) || math.IsInf(size, 1) {
+		return 0, fmt.Errorf("expected a size like 512KB or 2GB")
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which is already too large
+	if size*float64(multiplier) >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %s is too large", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// parseAge parses a duration like 30d, 2w or 12h. An empty string is 0.
+func parseAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	days := 0.0
+	switch {
+	case strings.HasSuffix(value, "d"):
+		days = 1
+	case strings.HasSuffix(value, "w"):
+		days = 7
+	}
+	if days > 0 {
+		count, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err != nil || !(count >= 0) || math.IsInf(count, 1) {
+			return 0, fmt.Errorf("expected a duration like 30d, 2w or 12h")
+		}
+		if count*days*float64(24*time.Hour) >= math.MaxInt64 {
+			return 0, fmt.Errorf("duration %s is too long", value)
+		}
+		return time.Duration(count * days * float64(24*time.Hour)), nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("expected a duration like 30d, 2w or 12h")
+	}
+	return age, nil
+}
+
+// readSSECustomerKey loads a 256-bit SSE-C key from an env var or a file
+// holding it base64 encoded (a file may also hold the 32 raw bytes).
+func readSSECustomerKey(src string) ([]byte, error) {
+	kind, value, _ := strings.Cut(src, ":")
+	var data []byte
+	switch kind {
+	case "env":
+		data = []byte(os.Getenv(value))
+		if len(data) == 0 {
+			return nil, fmt.Errorf("env var %s is empty", value)
+		}
+	case "file":
+		fileData, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(fileData) == 32 {
+			return fileData, nil
+		}
+		data = fileData
+	default:
+		return nil, fmt.Errorf("expected env:VAR or file:path, got %s", src)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 256 bits, got %d bits", len(key)*8)
+	}
+	return key, nil
 }
 
 func (t *TaskConfig) CreateS3Config(storageCls types.StorageClass) *nTypes.S3Config {
@@ -177,5 +606,52 @@ func (t *TaskConfig) CreateS3Config(storageCls types.StorageClass) *nTypes.S3Con
 		StorageClass:    storageCls,
 		Region:          t.AWSRegion,
 		S3Bucket:        t.S3Bucket,
+		PartSize:        t.UploadPartSize * 1024 * 1024,
+		Concurrency:     t.UploadConcurrency,
+		StateDir:        filepath.Join(t.WorkingDir, ".uploads"),
+		SSE:             t.sseMode(),
+		SSEKMSKeyID:     t.SSEKMSKeyID,
+		SSECustomerKey:  t.SSECustomerKey,
+		ObjectLockMode:  types.ObjectLockMode(t.ObjectLock.Mode),
+		ObjectLockDays:  t.ObjectLock.RetainDays,
+		LegalHold:       t.ObjectLock.LegalHold,
+	}
+}
+
+// Roots returns the source dirs of the task: its dirs, or its dir archived
+// without a prefix.
+func (t *TaskConfig) Roots() []Root {
+	if len(t.Dirs) > 0 {
+		return t.Dirs
+	}
+	return []Root{{Path: t.Dir}}
+}
+
+// SourcePath returns where an archived file of the task is on disk, or ""
+// when it is under none of its dirs.
+func (t *TaskConfig) SourcePath(archivePath string) string {
+	for _, root := range t.Roots() {
+		if relativePath, ok := root.Contains(archivePath); ok {
+			return filepath.Join(root.Path, filepath.FromSlash(relativePath))
+		}
+	}
+	return ""
+}
+
+// LockTTL is how long the task lock stays valid without a heartbeat.
+func (t *TaskConfig) LockTTL() time.Duration {
+	return time.Duration(t.LockTTLMinutes) * time.Minute
+}
+
+// HookTimeout is how long a hook of the task may run.
+func (t *TaskConfig) HookTimeout() time.Duration {
+	return time.Duration(t.HookTimeoutMinutes) * time.Minute
+}
+
+func (t *TaskConfig) sseMode() types.ServerSideEncryption {
+	if t.SSE == sseCustomer {
+		// SSE-C is requested with the customer key headers, not this one
+		return ""
 	}
+	return types.ServerSideEncryption(t.SSE)
 }
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		err   bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"1KB", 1 << 10, false},
+		{"1.5MB", 3 << 19, false},
+		{"2GB", 2 << 30, false},
+		{"1TB", 1 << 40, false},
+		{" 2 gb ", 2 << 30, false},
+		{"1kb", 1 << 10, false},
+		{"8388607TB", 8388607 << 40, false},
+		{"8388608TB", 0, true}, // 2^63 bytes
+		{"1e30TB", 0, true},
+		{"-1KB", 0, true},
+		{"-0.5", 0, true},
+		{"KB", 0, true},
+		{"5XB", 0, true},
+		{"5 PB", 0, true},
+		{"abc", 0, true},
+		{"NaN", 0, true},
+		{"InfGB", 0, true},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("parseSize(%q): error %v, want error %t", test.value, err, test.err)
+			continue
+		}
+		if size != test.size {
+			t.Errorf("parseSize(%q) = %d, want %d", test.value, size, test.size)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		value string
+		age   time.Duration
+		err   bool
+	}{
+		{"", 0, false},
+		{"30d", 30 * day, false},
+		{"0.5d", 12 * time.Hour, false},
+		{"2w", 14 * day, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{" 7d ", 7 * day, false},
+		{"106000d", 106000 * day, false},
+		{"107000d", 0, true}, // over the 292 years a duration holds
+		{"1e300w", 0, true},
+		{"99999999999h", 0, true},
+		{"-1d", 0, true},
+		{"-2h", 0, true},
+		{"d", 0, true},
+		{"1y", 0, true},
+		{"30 days", 0, true},
+		{"NaNd", 0, true},
+		{"Infw", 0, true},
+	}
+	for _, test := range tests {
+		age, err := parseAge(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("parseAge(%q): error %v, want error %t", test.value, err, test.err)
+			continue
+		}
+		if age != test.age {
+			t.Errorf("parseAge(%q) = %s, want %s", test.value, age, test.age)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package utils
+
+import (
+	"os"
+	nTypes "s3-diff-archive/types"
+)
+
+// ReadFileMeta returns the permission bits of the file. Owners and extended
+// attributes are only recorded on unix.
+func ReadFileMeta(filePath string, info os.FileInfo) (*nTypes.FileMeta, error) {
+	return &nTypes.FileMeta{Mode: uint32(info.Mode().Perm())}, nil
+}
+
+// ApplyFileMeta sets the permission bits of the file.
+func ApplyFileMeta(filePath string, meta *nTypes.FileMeta) error {
+	if meta == nil {
+		return nil
+	}
+	return os.Chmod(filePath, os.FileMode(meta.Mode).Perm())
+}
+
+// HardlinkID is not supported on this platform, every path is archived as a
+// file of its own.
+func HardlinkID(info os.FileInfo) (id string, ok bool) {
+	return "", false
+}
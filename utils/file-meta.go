@@ -0,0 +1,64 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	nTypes "s3-diff-archive/types"
+	"syscall"
+)
+
+const metaModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// ReadFileMeta returns the permissions, owner and extended attributes of the
+// file at filePath. info is its os.Stat.
+func ReadFileMeta(filePath string, info os.FileInfo) (*nTypes.FileMeta, error) {
+	meta := &nTypes.FileMeta{Mode: uint32(info.Mode() & metaModeBits)}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.UID = int(stat.Uid)
+		meta.GID = int(stat.Gid)
+	}
+	xattrs, err := readXattrs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	meta.Xattrs = xattrs
+	return meta, nil
+}
+
+// ApplyFileMeta sets the owner, permissions and extended attributes of the
+// file at filePath. Only root can give a file away, so other users keep the
+// ownership of the files they restore, and everything else is still applied.
+// The errors of every step are joined.
+func ApplyFileMeta(filePath string, meta *nTypes.FileMeta) error {
+	if meta == nil {
+		return nil
+	}
+	var errs []error
+	// ownership first, chown clears the setuid and setgid bits
+	if os.Geteuid() == 0 {
+		if err := os.Chown(filePath, meta.UID, meta.GID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.Chmod(filePath, os.FileMode(meta.Mode)&metaModeBits); err != nil {
+		errs = append(errs, err)
+	}
+	// after chmod, which rewrites the mask entry of an ACL
+	if err := writeXattrs(filePath, meta.Xattrs); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// HardlinkID identifies the inode of a file that has more than one link, so
+// the paths sharing it can be grouped. ok is false for files with one link.
+func HardlinkID(info os.FileInfo) (id string, ok bool) {
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat || stat.Nlink < 2 {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), true
+}
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IgnoreFileName is the name of the ignore files a dir of a task can hold.
+// They are read like .gitignore files and apply to the dir and its subdirs.
+const IgnoreFileName = ".s3diffignore"
+
+// A CACHEDIR.TAG starting with the signature marks its dir as a cache, see
+// https://bford.info/cachedir/
+const (
+	cacheDirTagName      = "CACHEDIR.TAG"
+	cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// The rules an entry can be skipped by.
+const (
+	RuleExclude       = "exclude"
+	RuleIgnoreFile    = "ignore file"
+	RuleInclude       = "include"
+	RuleMaxFileSize   = "max_file_size"
+	RuleMinFileSize   = "min_file_size"
+	RuleOlderThan     = "older_than"
+	RuleNewerThan     = "newer_than"
+	RuleExcludeCaches = "exclude_caches"
+)
+
+// Filter decides which entries below the dir of a task are archived. Rules
+// are applied in order of precedence: a file matching an exclude pattern of
+// the task is skipped, then one ignored by an ignore file, then, when the
+// task has include patterns, one matching none of them, then one outside the
+// size and age limits of the task. Only ignore files and exclude_caches skip
+// dirs, along with everything below them; the other rules apply to files.
+//
+// Paths given to a filter are relative to its root. Patterns of the task are
+// matched against the path the file is archived under, and the lines of an
+// ignore file against the path relative to its dir.
+type Filter struct {
+	root    Root
+	task    *TaskConfig
+	now     time.Time
+	ignores map[string][]*ignoreRule // rules of the ignore file of each dir, by its relative path
+}
+
+// ignoreRule is a line of an ignore file.
+type ignoreRule struct {
+	pattern string // matched against paths relative to the root
+	negate  bool   // the line starts with !, it re-includes what earlier lines ignored
+	dirOnly bool   // the line ends with /, it only matches dirs
+	source  string // file and line, for explanations
+}
+
+// NewFilter creates the filter of a task for the tree at root, which is
+// where its ignore files are read from.
+func NewFilter(task *TaskConfig, root Root) *Filter {
+	return &Filter{root: root, task: task, now: time.Now(), ignores: map[string][]*ignoreRule{}}
+}
+
+// SkipDir returns the rule that skips a dir, by its slash separated path,
+// and why, or "" when the dir is searched.
+func (f *Filter) SkipDir(relativePath string) (string, string) {
+	if reason := f.ignoredBy(relativePath, true); reason != "" {
+		return RuleIgnoreFile, reason
+	}
+	if f.task.ExcludeCaches && isCacheDir(filepath.Join(f.root.Path, filepath.FromSlash(relativePath))) {
+		return RuleExcludeCaches, "holds a " + cacheDirTagName
+	}
+	return "", ""
+}
+
+// SkipPath returns the rule that skips a file by its path alone, and why,
+// or "" when it is archived.
+func (f *Filter) SkipPath(relativePath string) (string, string) {
+	archivePath := f.root.ArchivePath(relativePath)
+	for _, pattern := range f.task.Excludes {
+		if MatchPattern(pattern, archivePath) {
+			return RuleExclude, "matches " + pattern
+		}
+	}
+	if reason := f.ignoredBy(relativePath, false); reason != "" {
+		return RuleIgnoreFile, reason
+	}
+	if len(f.task.Includes) > 0 {
+		for _, pattern := range f.task.Includes {
+			if MatchPattern(pattern, archivePath) {
+				return "", ""
+			}
+		}
+		return RuleInclude, "no include pattern matches"
+	}
+	return "", ""
+}
+
+// SkipEntry returns the rule that skips an entry by its path alone, or by
+// the path of a dir above it, and why, or "" when it is archived. It is for
+// entries that are not found by walking the root, like those of a backup.
+func (f *Filter) SkipEntry(relativePath string) (string, string) {
+	dirs := strings.Split(relativePath, "/")
+	for depth := 1; depth < len(dirs); depth++ {
+		if reason := f.ignoredBy(strings.Join(dirs[:depth], "/"), true); reason != "" {
+			return RuleIgnoreFile, reason
+		}
+	}
+	return f.SkipPath(relativePath)
+}
+
+// SkipFile returns the rule that skips a file by its path, size or
+// modification time, and why, or "" when it is archived. Only regular files
+// are filtered by size.
+func (f *Filter) SkipFile(relativePath string, info os.FileInfo) (string, string) {
+	if rule, reason := f.SkipPath(relativePath); rule != "" {
+		return rule, reason
+	}
+	if info.Mode().IsRegular() {
+		if f.task.MaxFileSize > 0 && info.Size() > f.task.MaxFileSize {
+			return RuleMaxFileSize, fmt.Sprintf("%d bytes is larger than %s", info.Size(), f.task.MaxFileSizeString)
+		}
+		if info.Size() < f.task.MinFileSize {
+			return RuleMinFileSize, fmt.Sprintf("%d bytes is smaller than %s", info.Size(), f.task.MinFileSizeString)
+		}
+	}
+	age := f.now.Sub(info.ModTime())
+	if f.task.OlderThan > 0 && age < f.task.OlderThan {
+		return RuleOlderThan, fmt.Sprintf("modified %s, less than %s ago", info.ModTime().Format(time.DateTime), f.task.OlderThanString)
+	}
+	if f.task.NewerThan > 0 && age > f.task.NewerThan {
+		return RuleNewerThan, fmt.Sprintf("modified %s, more than %s ago", info.ModTime().Format(time.DateTime), f.task.NewerThanString)
+	}
+	return "", ""
+}
+
+// isCacheDir reports whether a dir holds a valid CACHEDIR.TAG.
+func isCacheDir(dirPath string) bool {
+	file, err := os.Open(filepath.Join(dirPath, cacheDirTagName))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	signature := make([]byte, len(cacheDirTagSignature))
+	_, err = io.ReadFull(file, signature)
+	return err == nil && string(signature) == cacheDirTagSignature
+}
+
+// ignoredBy returns the line of an ignore file that ignores an entry. Like
+// with gitignore, the last matching line wins, and lines of ignore files in
+// deeper dirs come after those of their parents.
+func (f *Filter) ignoredBy(relativePath string, isDir bool) string {
+	var last *ignoreRule
+	dirs := strings.Split(relativePath, "/")
+	for depth := range dirs {
+		// the dirs above the entry, from the root down
+		for _, rule := range f.rulesOf(strings.Join(dirs[:depth], "/")) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if MatchPattern(rule.pattern, relativePath) {
+				last = rule
+			}
+		}
+	}
+	if last == nil || last.negate {
+		return ""
+	}
+	return "ignored by " + last.source
+}
+
+// rulesOf reads the ignore file of a dir, once.
+func (f *Filter) rulesOf(dir string) []*ignoreRule {
+	if rules, ok := f.ignores[dir]; ok {
+		return rules
+	}
+	ignorePath := path.Join(dir, IgnoreFileName)
+	data, err := os.ReadFile(filepath.Join(f.root.Path, filepath.FromSlash(ignorePath)))
+	if err != nil {
+		f.ignores[dir] = nil
+		return nil
+	}
+
+	rules := []*ignoreRule{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := &ignoreRule{source: fmt.Sprintf("%s:%d (%s)", f.root.ArchivePath(ignorePath), i+1, line)}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			// anchored to the dir of the ignore file
+			rule.pattern = path.Join(dir, strings.TrimPrefix(line, "/"))
+		} else {
+			// a name, matched at any depth below it
+			rule.pattern = path.Join(dir, "**", line)
+		}
+		rules = append(rules, rule)
+	}
+	f.ignores[dir] = rules
+	return rules
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTree creates the files of a tree under dir, by slash separated path.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFilterIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		IgnoreFileName: "# a comment\n" +
+			"*.log\n" +
+			"!keep.log\n" +
+			"/build\n" +
+			"cache/\n" +
+			"\\#hash\n",
+		"src/" + IgnoreFileName: "!debug.log\n" +
+			"gen/*.go\n" +
+			"/local\n",
+	})
+	filter := NewFilter(&TaskConfig{}, Root{Path: dir})
+
+	tests := []struct {
+		name    string
+		path    string
+		isDir   bool
+		skipped bool
+	}{
+		{"unanchored name at the root", "app.log", false, true},
+		{"unanchored name at any depth", "a/b/app.log", false, true},
+		{"negation re-includes", "keep.log", false, false},
+		{"negation at any depth", "a/keep.log", false, false},
+		{"anchored file at its dir", "build", false, true},
+		{"anchored dir at its dir", "build", true, true},
+		{"anchored pattern not at other depths", "a/build", true, false},
+		{"dir only rule skips dirs", "cache", true, true},
+		{"dir only rule skips nested dirs", "a/cache", true, true},
+		{"dir only rule keeps files", "cache", false, false},
+		{"escaped hash is a pattern", "#hash", false, true},
+		{"comment is not a pattern", "# a comment", false, false},
+		{"unmatched file", "main.go", false, false},
+		{"nested file overrides its parent", "src/debug.log", false, false},
+		{"parent rules still apply below", "src/other.log", false, true},
+		{"nested override stays in its dir", "debug.log", false, true},
+		{"nested pattern with a slash is anchored", "src/gen/a.go", false, true},
+		{"nested anchored pattern not elsewhere", "gen/a.go", false, false},
+		{"nested leading slash anchors to its dir", "src/local", false, true},
+		{"nested leading slash not at the root", "local", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rule string
+			if test.isDir {
+				rule, _ = filter.SkipDir(test.path)
+			} else {
+				rule, _ = filter.SkipPath(test.path)
+			}
+			if skipped := rule != ""; skipped != test.skipped {
+				t.Errorf("%s: skipped %t, want %t", test.path, skipped, test.skipped)
+			}
+			if test.skipped && rule != RuleIgnoreFile {
+				t.Errorf("%s: skipped by %s, want %s", test.path, rule, RuleIgnoreFile)
+			}
+		})
+	}
+}
+
+func TestFilterSkipEntry(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		IgnoreFileName: "cache/\n*.tmp\n",
+	})
+	filter := NewFilter(&TaskConfig{Task: Task{Excludes: []string{"**/*.bak"}}}, Root{Path: dir, Prefix: "home"})
+
+	tests := []struct {
+		path string
+		rule string
+	}{
+		{"cache/a.txt", RuleIgnoreFile},
+		{"a/cache/b/c.txt", RuleIgnoreFile},
+		{"a/b.tmp", RuleIgnoreFile},
+		{"a/b.bak", RuleExclude},
+		{"cache", ""},
+		{"a/b.txt", ""},
+	}
+	for _, test := range tests {
+		if rule, _ := filter.SkipEntry(test.path); rule != test.rule {
+			t.Errorf("%s: skipped by %q, want %q", test.path, rule, test.rule)
+		}
+	}
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		IgnoreFileName: "*.tmp\n",
+	})
+	task := &TaskConfig{Task: Task{
+		Excludes: []string{"**/secret*"},
+		Includes: []string{"**/*.txt", "**/*.tmp"},
+	}}
+	filter := NewFilter(task, Root{Path: dir})
+
+	tests := []struct {
+		path string
+		rule string
+	}{
+		{"secret.txt", RuleExclude},
+		{"a.tmp", RuleIgnoreFile},
+		{"a.jpg", RuleInclude},
+		{"a/b.txt", ""},
+	}
+	for _, test := range tests {
+		if rule, _ := filter.SkipPath(test.path); rule != test.rule {
+			t.Errorf("%s: skipped by %q, want %q", test.path, rule, test.rule)
+		}
+	}
+}
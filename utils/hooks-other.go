@@ -0,0 +1,8 @@
+//go:build !unix
+
+package utils
+
+import "os/exec"
+
+// killGroupOnCancel only kills the shell on this platform.
+func killGroupOnCancel(cmd *exec.Cmd) {}
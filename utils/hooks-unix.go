@@ -0,0 +1,17 @@
+//go:build unix
+
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroupOnCancel starts the command in a process group of its own and
+// kills the whole group when it times out, not only the shell.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RunHook runs a hook command of a task through the shell, like Notify runs
+// scripts, with env added to the environment as S3DA_<key> variables. It
+// returns the combined output of the command. A command still running after
+// timeout is killed and reported as failed.
+func RunHook(command string, timeout time.Duration, env map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := ShellCommand(ctx, command)
+	cmd.Env = os.Environ()
+	keys := []string{}
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cmd.Env = append(cmd.Env, "S3DA_"+key+"="+env[key])
+	}
+	// children that left the group may keep the output open
+	cmd.WaitDelay = 5 * time.Second
+
+	output, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return strings.TrimSpace(string(output)), err
+}
+
+// ShellCommand runs a command line through the shell. When ctx is done, the
+// command is killed along with the processes it started.
+func ShellCommand(ctx context.Context, command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	killGroupOnCancel(cmd)
+	return cmd
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package utils
+
+import "os"
+
+// lockFile does not lock on this platform.
+func lockFile(file *os.File) error { return nil }
+
+func unlockFile(file *os.File) error { return nil }
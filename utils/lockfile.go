@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const workingDirLockName = ".lock"
+
+// errLocked is returned by lockFile when another open file holds the lock.
+var errLocked = errors.New("file is locked")
+
+// LockWorkingDir locks a lock file in the working dir so that two processes
+// on this host don't use it at once. The lock is held by the open file, so
+// the system releases it when the process exits, however it exits, and a
+// lock file left behind is simply locked again. The returned func releases
+// the lock.
+func LockWorkingDir(workingDir string) (func(), error) {
+	if err := os.MkdirAll(workingDir, 0755); err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(workingDir, workingDirLockName)
+
+	// the file is never removed, a process could lock it once removed while
+	// another creates a new one
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if !errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("failed to lock working dir %s: %w", workingDir, err)
+		}
+		// the file may not be readable while locked on some platforms
+		data, _ := os.ReadFile(lockPath)
+		pid, _ := strconv.Atoi(strings.TrimSpace(strings.Split(string(data), "\n")[0]))
+		if pid > 0 {
+			return nil, fmt.Errorf("working dir %s is in use by process %d (lock file %s)", workingDir, pid, lockPath)
+		}
+		return nil, fmt.Errorf("working dir %s is in use by another process (lock file %s)", workingDir, lockPath)
+	}
+
+	hostname, _ := os.Hostname()
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(fmt.Sprintf("%d\n%s\n%s\n", os.Getpid(), hostname, NowTime())), 0)
+	}
+	return func() {
+		_ = file.Truncate(0)
+		_ = unlockFile(file)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLockWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+
+	unlock, err := LockWorkingDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lock is held per open file, so a second lock of this process
+	// conflicts like one of another process would; windows does not let the
+	// lock file be read while it is locked, so the pid is not reported there
+	if _, err := LockWorkingDir(dir); err == nil {
+		t.Fatal("locked a working dir that is already locked")
+	} else if want := fmt.Sprintf("in use by process %d", os.Getpid()); runtime.GOOS != "windows" && !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q, want it to contain %q", err, want)
+	}
+	unlock()
+
+	unlock, err = LockWorkingDir(dir)
+	if err != nil {
+		t.Fatalf("failed to lock a released working dir: %s", err)
+	}
+	unlock()
+
+	// a lock file left by a process that is gone is not locked
+	if err := os.WriteFile(filepath.Join(dir, workingDirLockName), []byte("999999\nhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = LockWorkingDir(dir)
+	if err != nil {
+		t.Fatalf("failed to lock over a left lock file: %s", err)
+	}
+	unlock()
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"os"
+	nTypes "s3-diff-archive/types"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileHoles returns the holes of an open file, or nil when it is not sparse.
+// Files with as many blocks allocated as their size need are not searched.
+func FileHoles(file *os.File, info os.FileInfo) ([]nTypes.Extent, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	size := info.Size()
+	if !ok || size == 0 || stat.Blocks*512 >= size {
+		return nil, nil
+	}
+
+	fd := int(file.Fd())
+	holes := []nTypes.Extent{}
+	offset := int64(0)
+	for offset < size {
+		hole, err := unix.Seek(fd, offset, unix.SEEK_HOLE)
+		if err != nil {
+			if errors.Is(err, unix.EINVAL) {
+				// the file system doesn't support searching for holes
+				return nil, nil
+			}
+			return nil, err
+		}
+		if hole >= size {
+			break
+		}
+		data, err := unix.Seek(fd, hole, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// a hole up to the end of the file
+			data = size
+		} else if err != nil {
+			return nil, err
+		}
+		holes = append(holes, nTypes.Extent{Offset: hole, Length: data - hole})
+		offset = data
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if len(holes) == 0 {
+		return nil, nil
+	}
+	return holes, nil
+}
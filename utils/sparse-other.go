@@ -0,0 +1,14 @@
+//go:build !linux
+
+package utils
+
+import (
+	"os"
+	nTypes "s3-diff-archive/types"
+)
+
+// FileHoles only finds holes on linux, sparse files are read in full
+// elsewhere.
+func FileHoles(file *os.File, info os.FileInfo) ([]nTypes.Extent, error) {
+	return nil, nil
+}
@@ -0,0 +1,36 @@
+//go:build !linux && !darwin
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	nTypes "s3-diff-archive/types"
+)
+
+// SpecialFileType returns the FileType of a FIFO, socket or device, or an
+// empty string for other files.
+func SpecialFileType(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return nTypes.FileTypeFIFO
+	case mode&os.ModeSocket != 0:
+		return nTypes.FileTypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return nTypes.FileTypeChar
+	case mode&os.ModeDevice != 0:
+		return nTypes.FileTypeDevice
+	}
+	return ""
+}
+
+// DeviceNumber is only known on linux and macOS.
+func DeviceNumber(info os.FileInfo) uint64 {
+	return 0
+}
+
+// MakeSpecialFile is only supported on linux and macOS.
+func MakeSpecialFile(filePath, fileType string, device uint64) error {
+	return fmt.Errorf("cannot create %s, a %s, on this platform", filePath, fileType)
+}
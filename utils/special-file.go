@@ -0,0 +1,57 @@
+//go:build linux || darwin
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	nTypes "s3-diff-archive/types"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SpecialFileType returns the FileType of a FIFO, socket or device, or an
+// empty string for other files.
+func SpecialFileType(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return nTypes.FileTypeFIFO
+	case mode&os.ModeSocket != 0:
+		return nTypes.FileTypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return nTypes.FileTypeChar
+	case mode&os.ModeDevice != 0:
+		return nTypes.FileTypeDevice
+	}
+	return ""
+}
+
+// DeviceNumber returns the device a device file refers to.
+func DeviceNumber(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Rdev)
+	}
+	return 0
+}
+
+// MakeSpecialFile creates a FIFO or a device file. Sockets only exist while
+// a process listens on them and cannot be created.
+func MakeSpecialFile(filePath, fileType string, device uint64) error {
+	var err error
+	switch fileType {
+	case nTypes.FileTypeFIFO:
+		err = unix.Mkfifo(filePath, 0644)
+	case nTypes.FileTypeDevice:
+		err = unix.Mknod(filePath, unix.S_IFBLK|0644, int(device))
+	case nTypes.FileTypeChar:
+		err = unix.Mknod(filePath, unix.S_IFCHR|0644, int(device))
+	default:
+		return fmt.Errorf("cannot create %s, a %s", filePath, fileType)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s %s: %w", fileType, filePath, err)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -99,6 +101,19 @@ func NowTime() string {
 	return time.Now().Format("2006-01-02 15:04:05")
 }
 
+// NewRunID identifies an archive run. Run ids are UTC timestamps, so they sort
+// chronologically.
+func NewRunID() string {
+	return time.Now().UTC().Format(runIDLayout)
+}
+
+const runIDLayout = "2006_01_02_15_04_05"
+
+// RunTime returns when the run with the given id started.
+func RunTime(runID string) (time.Time, error) {
+	return time.Parse(runIDLayout, runID)
+}
+
 func ToJson(data any) string {
 	dataJson, err := json.Marshal(data)
 	if err != nil {
@@ -131,6 +146,21 @@ func CopyFile(src, dst string) error {
 	return out.Close()
 }
 
+// FileSHA256 returns the hex encoded SHA-256 checksum of a file.
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func MatchPattern(pattern string, path string) bool {
 
 	match, err := doublestar.PathMatch(pattern, path)
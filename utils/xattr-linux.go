@@ -0,0 +1,77 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file, including the
+// system.posix_acl_access and system.posix_acl_default attributes that hold
+// its POSIX ACLs. Attributes the user may not read are left out.
+func readXattrs(filePath string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(filePath, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list xattrs of %s: %w", filePath, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(filePath, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs of %s: %w", filePath, err)
+	}
+
+	xattrs := map[string][]byte{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := getXattr(filePath, name)
+		if err != nil {
+			if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.ENODATA) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read xattr %s of %s: %w", name, filePath, err)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+func getXattr(filePath, name string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(filePath, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Getxattr(filePath, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			// grown in between, try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+}
+
+func writeXattrs(filePath string, xattrs map[string][]byte) error {
+	var errs []error
+	for name, value := range xattrs {
+		if err := unix.Setxattr(filePath, name, value, 0); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set xattr %s of %s: %w", name, filePath, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package utils
+
+// Extended attributes are only recorded on linux.
+
+func readXattrs(filePath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(filePath string, xattrs map[string][]byte) error {
+	return nil
+}
@@ -2,27 +2,54 @@ package utils
 
 import (
 	// "archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	nTypes "s3-diff-archive/types"
 	"strings"
+	"time"
 
 	"github.com/alexmullins/zip"
 )
 
-func ZipFile(filePath string, filename string, fileStat *os.FileInfo, zipWriter *zip.Writer, password string) {
+// ZipFile adds a file to the zip and returns the hex SHA-256 of its content.
+// With sparse, the holes of a sparse file are left out and returned; the
+// entry then holds the data between them back to back, and the checksum is
+// of that data.
+func ZipFile(filePath string, filename string, fileStat *os.FileInfo, zipWriter *zip.Writer, password string, sparse bool) (string, []nTypes.Extent, error) {
+	if !(*fileStat).Mode().IsRegular() {
+		// opening a FIFO for reading blocks until something writes to it
+		return "", nil, fmt.Errorf("failed to zip %s: not a regular file", filePath)
+	}
 	fileToZip, err := os.Open(filePath)
 	if err != nil {
-		log.Fatalf("failed to open file %s: %v", filePath, err)
+		return "", nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
 	defer fileToZip.Close()
 
+	var holes []nTypes.Extent
+	var content io.Reader = fileToZip
+	if sparse {
+		holes, err = FileHoles(fileToZip, *fileStat)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to find the holes of %s: %w", filePath, err)
+		}
+		if holes != nil {
+			readers := []io.Reader{}
+			for _, extent := range nTypes.DataExtents(holes, (*fileStat).Size()) {
+				readers = append(readers, io.NewSectionReader(fileToZip, extent.Offset, extent.Length))
+			}
+			content = io.MultiReader(readers...)
+		}
+	}
+
 	var w io.Writer
 	header, err := zip.FileInfoHeader(*fileStat)
 	if err != nil {
-		log.Fatalf("failed to create zip header: %v", err)
+		return "", nil, fmt.Errorf("failed to create zip header: %w", err)
 	}
 	header.Name = filename
 	header.Method = zip.Deflate
@@ -31,31 +58,127 @@ func ZipFile(filePath string, filename string, fileStat *os.FileInfo, zipWriter
 	}
 	w, err = zipWriter.CreateHeader(header)
 	if err != nil {
-		log.Fatalf("failed to create zip entry: %v", err)
+		return "", nil, fmt.Errorf("failed to create zip entry: %w", err)
 	}
 
-	_, err = io.Copy(w, fileToZip)
+	checksum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, checksum), content)
 	if err != nil {
-		log.Fatalf("failed to copy file data to zip: %v", err)
+		return "", nil, fmt.Errorf("failed to copy file data to zip: %w", err)
 	}
+	return hex.EncodeToString(checksum.Sum(nil)), holes, nil
 }
 
-func Unzip(zipPath, destDir, password string) error {
+// ZipStream adds an entry holding everything read from r, for content that
+// is not a file on disk, and returns the hex SHA-256 of the content and its
+// size.
+func ZipStream(r io.Reader, filename string, mtime time.Time, zipWriter *zip.Writer, password string) (string, int64, error) {
+	header := &zip.FileHeader{Name: filename, Method: zip.Deflate}
+	header.SetModTime(mtime)
+	header.SetMode(0644)
+	if password != "" {
+		header.SetPassword(password)
+	}
+	w, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create zip entry: %w", err)
+	}
+
+	checksum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, checksum), r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), size, nil
+}
+
+// HashZipEntries reads every entry of the zip and calls fn with the hex
+// SHA-256 of its content. Reading an entry also verifies its CRC, so an entry
+// that cannot be decrypted or decompressed is reported through fn's err.
+func HashZipEntries(zipPath, password string, fn func(name, checksum string, err error) error) error {
 	readCloser, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return fmt.Errorf("failed to open zip file %s: %w", zipPath, err)
 	}
 	defer readCloser.Close()
 
+	for _, file := range readCloser.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if file.IsEncrypted() && password != "" {
+			file.SetPassword(password)
+		}
+		checksum, err := hashZipEntry(file)
+		if err := fn(file.Name, checksum, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashZipEntry(file *zip.File) (string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func Unzip(zipPath, destDir, password string) error {
+	return UnzipSelected(zipPath, destDir, password, nil)
+}
+
+// UnzipSelected extracts the entries of a zip for which selected returns
+// true, or every entry when selected is nil.
+func UnzipSelected(zipPath, destDir, password string, selected func(name string) bool) error {
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
 	}
+	return UnzipTo(zipPath, password, func(name string) (*ExtractTo, error) {
+		if selected != nil && !selected(name) {
+			return nil, nil
+		}
+		filePath := filepath.Join(destDir, name)
+		if !strings.HasPrefix(filePath, filepath.Clean(destDir)+string(os.PathSeparator)) {
+			return nil, fmt.Errorf("invalid file path in zip: %s", name)
+		}
+		return &ExtractTo{Path: filePath}, nil
+	})
+}
+
+// ExtractTo is where UnzipTo writes an entry. The entry of a sparse file
+// holds the data between its holes back to back; it is written around the
+// holes, which are left unallocated, up to Size.
+type ExtractTo struct {
+	Path  string
+	Holes []nTypes.Extent
+	Size  int64
+}
+
+// UnzipTo extracts every entry of a zip to where dest says, skipping entries
+// for which it returns nil.
+func UnzipTo(zipPath, password string, dest func(name string) (*ExtractTo, error)) error {
+	readCloser, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip file %s: %w", zipPath, err)
+	}
+	defer readCloser.Close()
 
 	for _, file := range readCloser.File {
-		filePath := filepath.Join(destDir, file.Name)
-		if !strings.HasPrefix(filePath, filepath.Clean(destDir)+string(os.PathSeparator)) {
-			return fmt.Errorf("invalid file path in zip: %s", file.Name)
+		target, err := dest(file.Name)
+		if err != nil {
+			return err
 		}
+		if target == nil {
+			continue
+		}
+		filePath := target.Path
 
 		modTime := file.ModTime()
 
@@ -91,7 +214,11 @@ func Unzip(zipPath, destDir, password string) error {
 			return fmt.Errorf("failed to create output file %s: %w", filePath, err)
 		}
 
-		_, err = io.Copy(outFile, rc)
+		if target.Holes != nil {
+			err = writeSparse(outFile, rc, target.Holes, target.Size)
+		} else {
+			_, err = io.Copy(outFile, rc)
+		}
 		outFile.Close()
 		rc.Close()
 		if err != nil {
@@ -106,3 +233,17 @@ func Unzip(zipPath, destDir, password string) error {
 
 	return nil
 }
+
+// writeSparse writes the data of a sparse file at its offsets, seeking over
+// the holes so they are not allocated.
+func writeSparse(outFile *os.File, content io.Reader, holes []nTypes.Extent, size int64) error {
+	for _, extent := range nTypes.DataExtents(holes, size) {
+		if _, err := outFile.Seek(extent.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(outFile, content, extent.Length); err != nil {
+			return err
+		}
+	}
+	return outFile.Truncate(size)
+}